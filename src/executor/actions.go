@@ -0,0 +1,448 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"logger"
+	"runtime-schema/models"
+)
+
+var ErrRunTimedOut = errors.New("run action timed out")
+var ErrUnknownAction = errors.New("unknown action")
+var ErrUnknownContainer = errors.New("unknown container")
+var ErrCancelled = errors.New("cancelled")
+var ErrDownloadTimedOut = errors.New("download timed out")
+var ErrUnsafeArchiveEntry = errors.New("archive entry leaves its destination")
+
+const downloadTimeout = 10 * time.Minute
+
+var downloadTransport = &http.Transport{
+	Dial: (&net.Dialer{
+		Timeout: 30 * time.Second,
+	}).Dial,
+	ResponseHeaderTimeout: 30 * time.Second,
+}
+
+var downloadClient = &http.Client{
+	Transport: downloadTransport,
+}
+
+// performActions runs each of the task's actions in order, inside taskDir.
+// Paths in file actions are interpreted relative to taskDir, whether or not
+// they are absolute. Scripts of run actions are run from taskDir, with TMPDIR
+// pointing inside it, and should refer to the task's files by relative paths.
+// The contents of the last file fetched by a FetchResultAction are returned
+// as the task's result.
+// Closing cancel kills any running process and skips the remaining actions.
+func performActions(task *models.Task, taskDir string, output io.Writer, cancel <-chan struct{}) (string, error) {
+	var result string
+
+	for i, action := range task.Actions {
+		var err error
+
+		select {
+		case <-cancel:
+			return "", ErrCancelled
+		default:
+		}
+
+		switch a := action.Action.(type) {
+		case models.DownloadAction:
+			err = performDownload(task, taskDir, a, cancel)
+		case models.RunAction:
+			err = performRun(task, taskDir, a, output, cancel)
+		case models.UploadAction:
+			err = performUpload(task, taskDir, a)
+		case models.FetchResultAction:
+			result, err = performFetchResult(task, taskDir, a)
+		default:
+			err = ErrUnknownAction
+		}
+
+		if err == ErrCancelled {
+			return "", err
+		}
+
+		if err != nil {
+			return "", fmt.Errorf("action %d failed: %s", i, err)
+		}
+	}
+
+	return result, nil
+}
+
+func performDownload(task *models.Task, taskDir string, action models.DownloadAction, cancel <-chan struct{}) error {
+	logger.Info("task.download", map[string]interface{}{
+		"task":    task.Guid,
+		"from":    action.From,
+		"to":      action.To,
+		"extract": action.Extract,
+	})
+
+	request, err := http.NewRequest("GET", action.From, nil)
+	if err != nil {
+		return err
+	}
+
+	download := &abortableDownload{request: request}
+
+	finished := make(chan struct{})
+	defer close(finished)
+
+	go func() {
+		select {
+		case <-cancel:
+			download.abort(ErrCancelled)
+		case <-time.After(downloadTimeout):
+			download.abort(ErrDownloadTimedOut)
+		case <-finished:
+		}
+	}()
+
+	response, err := downloadClient.Do(request)
+	if err != nil {
+		return download.reason(err)
+	}
+
+	defer response.Body.Close()
+
+	if !download.reading(response.Body) {
+		return download.reason(nil)
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("download failed: %s", response.Status)
+	}
+
+	destination := scratchPath(taskDir, action.To)
+
+	if action.Extract {
+		return download.reason(extractArchive(response.Body, taskDir, destination))
+	}
+
+	err = os.MkdirAll(filepath.Dir(destination), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	_, err = io.Copy(file, response.Body)
+
+	return download.reason(err)
+}
+
+// abortableDownload can be abandoned at any point, including part way
+// through reading the body.
+type abortableDownload struct {
+	request *http.Request
+	body    io.Closer
+	aborted error
+
+	lock sync.Mutex
+}
+
+func (download *abortableDownload) abort(reason error) {
+	download.lock.Lock()
+	defer download.lock.Unlock()
+
+	download.aborted = reason
+
+	downloadTransport.CancelRequest(download.request)
+
+	if download.body != nil {
+		download.body.Close()
+	}
+}
+
+// reading registers the body to be closed on abort, returning false if the
+// download has already been aborted.
+func (download *abortableDownload) reading(body io.Closer) bool {
+	download.lock.Lock()
+	defer download.lock.Unlock()
+
+	download.body = body
+
+	return download.aborted == nil
+}
+
+// reason explains a failure, preferring the reason for aborting over
+// whatever error the abort caused.
+func (download *abortableDownload) reason(err error) error {
+	download.lock.Lock()
+	defer download.lock.Unlock()
+
+	if download.aborted != nil {
+		return download.aborted
+	}
+
+	return err
+}
+
+func performRun(task *models.Task, taskDir string, action models.RunAction, output io.Writer, cancel <-chan struct{}) error {
+	logger.Info("task.run", map[string]interface{}{
+		"task":    task.Guid,
+		"script":  action.Script,
+		"timeout": action.Timeout.String(),
+	})
+
+	tmpDir := filepath.Join(taskDir, "tmp")
+
+	err := os.MkdirAll(tmpDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("/bin/bash", "-c", action.Script)
+	cmd.Dir = taskDir
+	cmd.Env = append(os.Environ(), "TMPDIR="+tmpDir)
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	// in its own process group, so that killing it takes its children too;
+	// otherwise they would hold the output open and keep Wait from returning
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	for _, pair := range action.Env {
+		if len(pair) != 2 {
+			return fmt.Errorf("invalid environment variable: %v", pair)
+		}
+
+		cmd.Env = append(cmd.Env, pair[0]+"="+pair[1])
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	exited := make(chan error, 1)
+
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	var timeout <-chan time.Time
+	if action.Timeout > 0 {
+		timeout = time.After(action.Timeout)
+	}
+
+	select {
+	case err := <-exited:
+		return err
+	case <-timeout:
+		killProcessGroup(cmd)
+		<-exited
+		return ErrRunTimedOut
+	case <-cancel:
+		killProcessGroup(cmd)
+		<-exited
+		return ErrCancelled
+	}
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+func performUpload(task *models.Task, taskDir string, action models.UploadAction) error {
+	logger.Info("task.upload", map[string]interface{}{
+		"task": task.Guid,
+		"from": action.From,
+		"to":   action.To,
+	})
+
+	file, err := os.Open(scratchPath(taskDir, action.From))
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", action.To, file)
+	if err != nil {
+		return err
+	}
+
+	request.ContentLength = info.Size()
+	request.Header.Set("Content-Type", "application/octet-stream")
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("upload failed: %s", response.Status)
+	}
+
+	return nil
+}
+
+func performFetchResult(task *models.Task, taskDir string, action models.FetchResultAction) (string, error) {
+	logger.Info("task.fetch-result", map[string]interface{}{
+		"task": task.Guid,
+		"file": action.File,
+	})
+
+	result, err := ioutil.ReadFile(scratchPath(taskDir, action.File))
+	if err != nil {
+		return "", err
+	}
+
+	return string(result), nil
+}
+
+// scratchPath roots a path from an action in the task's scratch directory,
+// so that e.g. "/app" becomes "<taskDir>/app".
+func scratchPath(taskDir string, path string) string {
+	return filepath.Join(taskDir, filepath.Clean("/"+path))
+}
+
+// extractArchive unpacks a tar (optionally gzipped) into destination. Nothing
+// may be written outside of root, whether by the entry's own path or by way
+// of a symlink created by an earlier entry.
+func extractArchive(source io.Reader, root string, destination string) error {
+	buffered := bufio.NewReader(source)
+
+	var archive io.Reader = buffered
+
+	magic, err := buffered.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+
+		defer gzipReader.Close()
+
+		archive = gzipReader
+	}
+
+	err = os.MkdirAll(destination, 0755)
+	if err != nil {
+		return err
+	}
+
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+
+	tarReader := tar.NewReader(archive)
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		path := scratchPath(destination, header.Name)
+		mode := os.FileMode(header.Mode)
+
+		if !resolvesWithin(root, path) {
+			return ErrUnsafeArchiveEntry
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, mode)
+		case tar.TypeSymlink:
+			if filepath.IsAbs(header.Linkname) || !resolvesWithin(root, filepath.Join(filepath.Dir(path), header.Linkname)) {
+				return ErrUnsafeArchiveEntry
+			}
+
+			err = os.Symlink(header.Linkname, path)
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractFile(tarReader, path, mode)
+		default:
+			if strings.HasSuffix(header.Name, "/") {
+				err = os.MkdirAll(path, mode)
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// resolvesWithin reports whether path, with any symlinks along the part of it
+// that exists resolved, is inside root. root must already be resolved.
+func resolvesWithin(root string, path string) bool {
+	existing := filepath.Clean(path)
+	remainder := ""
+
+	for {
+		_, err := os.Lstat(existing)
+		if err == nil {
+			break
+		}
+
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return false
+		}
+
+		remainder = filepath.Join(filepath.Base(existing), remainder)
+		existing = parent
+	}
+
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return false
+	}
+
+	resolved = filepath.Join(resolved, remainder)
+
+	return resolved == root || strings.HasPrefix(resolved, root+string(filepath.Separator))
+}
+
+func extractFile(source io.Reader, path string, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	_, err = io.Copy(file, source)
+
+	return err
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"logger"
+	"runtime-schema/models"
+)
+
+const (
+	TaskPhaseClaimed    = "claimed"
+	TaskPhaseRunning    = "running"
+	TaskPhaseCompleting = "completing"
+)
+
+// OwnedTask is a task that this executor has claimed and not yet let go of.
+type OwnedTask struct {
+	Task      models.Task `json:"task"`
+	Phase     string      `json:"phase"`
+	StartedAt int64       `json:"started_at"`
+
+	// closed when the stager asks for the task to be cancelled; cancelled
+	// holds the task as it was stored at that point
+	cancel    chan struct{}
+	cancelled *models.Task
+}
+
+// trackTask records a claim this executor has just made. Each claim is
+// tracked on its own: after a stall and a demotion this executor may claim
+// the same guid again while the first claim is still winding down.
+func (handler *Handler) trackTask(task *models.Task) *OwnedTask {
+	handler.ownedTasksMutex.Lock()
+	defer handler.ownedTasksMutex.Unlock()
+
+	owned := &OwnedTask{
+		Task:      *task,
+		Phase:     TaskPhaseClaimed,
+		StartedAt: time.Now().UnixNano(),
+		cancel:    make(chan struct{}),
+	}
+
+	handler.ownedTasks[task.Guid] = owned
+
+	return owned
+}
+
+func (handler *Handler) updateTask(owned *OwnedTask, task *models.Task, phase string) {
+	handler.ownedTasksMutex.Lock()
+	defer handler.ownedTasksMutex.Unlock()
+
+	owned.Task = *task
+	owned.Phase = phase
+}
+
+// untrackTask forgets a claim, unless its guid has been claimed again since.
+func (handler *Handler) untrackTask(owned *OwnedTask) {
+	handler.ownedTasksMutex.Lock()
+	defer handler.ownedTasksMutex.Unlock()
+
+	if handler.ownedTasks[owned.Task.Guid] == owned {
+		delete(handler.ownedTasks, owned.Task.Guid)
+	}
+}
+
+func (handler *Handler) Capacity() models.ExecutorCapacity {
+	handler.resourcesMutex.Lock()
+	defer handler.resourcesMutex.Unlock()
+
+	return models.ExecutorCapacity{
+		Total:     handler.totalResources,
+		Remaining: handler.remainingResources,
+	}
+}
+
+func (handler *Handler) getCapacity(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, http.StatusOK, handler.Capacity())
+}
+
+func (handler *Handler) listTasks(writer http.ResponseWriter, request *http.Request) {
+	handler.ownedTasksMutex.RLock()
+
+	tasks := []OwnedTask{}
+	for _, owned := range handler.ownedTasks {
+		tasks = append(tasks, *owned)
+	}
+
+	handler.ownedTasksMutex.RUnlock()
+
+	writeJSON(writer, http.StatusOK, tasks)
+}
+
+func (handler *Handler) getTask(writer http.ResponseWriter, request *http.Request) {
+	guid := request.URL.Query().Get(":guid")
+
+	handler.ownedTasksMutex.RLock()
+
+	owned, found := handler.ownedTasks[guid]
+
+	var task OwnedTask
+	if found {
+		task = *owned
+	}
+
+	handler.ownedTasksMutex.RUnlock()
+
+	if !found {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, task)
+}
+
+func writeJSON(writer http.ResponseWriter, status int, value interface{}) {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		logger.Error("handler.marshal-failed", map[string]interface{}{
+			"error": err.Error(),
+		})
+
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	writer.Write(payload)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"time"
+
+	"logger"
+	"runtime-schema/bbs"
+	"runtime-schema/models"
+)
+
+// watchForCancellations aborts any owned task that the stager cancels.
+func watchForCancellations(bbs bbs.ExecutorBBS, handler *Handler) {
+	for {
+		cancelledTasks, stopWatching, errs := bbs.WatchForCancelledTask()
+
+	watching:
+		for {
+			select {
+			case task, ok := <-cancelledTasks:
+				if !ok {
+					break watching
+				}
+
+				handler.cancelTask(task)
+
+			case err, ok := <-errs:
+				if ok {
+					logger.Error("cancellations.watch-failed", map[string]interface{}{
+						"error": err.Error(),
+					})
+				}
+
+				break watching
+
+			case <-stop:
+				close(stopWatching)
+				return
+			}
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// cancelTask signals the goroutine running the task to abort, if the task is
+// ours. Only the first cancellation counts.
+func (handler *Handler) cancelTask(task *models.Task) {
+	handler.ownedTasksMutex.Lock()
+	defer handler.ownedTasksMutex.Unlock()
+
+	owned, found := handler.ownedTasks[task.Guid]
+	if !found || owned.cancelled != nil {
+		return
+	}
+
+	logger.Info("task.cancel-requested", map[string]interface{}{
+		"task": task.Guid,
+	})
+
+	owned.cancelled = task
+	close(owned.cancel)
+}
+
+// completeIfCancelled records a cancelled task as failed, returning whether
+// it was cancelled. Completion is done against the task as the stager left
+// it, as our own copy is out of date.
+func (handler *Handler) completeIfCancelled(task *models.Task, owned *OwnedTask) bool {
+	handler.ownedTasksMutex.RLock()
+
+	var cancelled *models.Task
+	if owned.cancelled != nil {
+		stored := *owned.cancelled
+		cancelled = &stored
+	}
+
+	handler.ownedTasksMutex.RUnlock()
+
+	if cancelled == nil {
+		return false
+	}
+
+	logger.Info("task.cancelled", map[string]interface{}{
+		"task": task.Guid,
+	})
+
+	err := handler.bbs.CompleteTask(cancelled, true, bbs.TaskCancelledReason, "")
+	if err != nil {
+		logger.Error(storeFailure("task.complete", err), map[string]interface{}{
+			"task":  task.Guid,
+			"error": err.Error(),
+		})
+	}
+
+	return true
+}
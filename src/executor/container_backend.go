@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"logger"
+
+	"runtime-schema/models"
+)
+
+type ContainerBackend interface {
+	// Create allocates a container for the task, returning its handle.
+	Create(task *models.Task) (handle string, err error)
+
+	// Run performs the task's actions in the container identified by handle,
+	// streaming process output to the given writer. The returned string is
+	// the task's result. If cancel is closed, Run gives up as soon as it can
+	// and returns ErrCancelled.
+	Run(handle string, task *models.Task, output io.Writer, cancel <-chan struct{}) (result string, err error)
+
+	// Destroy tears down the container and anything left inside it.
+	Destroy(handle string) error
+}
+
+func NewContainerBackend(name string, phases PhaseDistributions) (ContainerBackend, error) {
+	switch name {
+	case "fake":
+		return NewFakeBackend(phases), nil
+	case "local":
+		return NewLocalBackend(*tempDir), nil
+	default:
+		return nil, fmt.Errorf("unknown container backend: %s", name)
+	}
+}
+
+// taskOutput forwards a task's process output to the logger.
+type taskOutput struct {
+	task *models.Task
+}
+
+func (output taskOutput) Write(data []byte) (int, error) {
+	logger.Info("task.output", map[string]interface{}{
+		"task":   output.task.Guid,
+		"output": string(data),
+	})
+
+	return len(data), nil
+}
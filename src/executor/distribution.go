@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"logger"
+	"runtime-schema/models"
+)
+
+var ErrNoSamples = errors.New("empirical distribution has no samples")
+var ErrEmpiricalNotAllowed = errors.New("empirical distributions cannot be requested by a task")
+
+// maxCachedOverrides bounds the number of distinct per-task phase durations
+// kept parsed at once.
+const maxCachedOverrides = 256
+
+// Distribution produces durations for simulated phases of running a task.
+type Distribution interface {
+	Sample() time.Duration
+}
+
+type UniformDistribution struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+func (d UniformDistribution) Sample() time.Duration {
+	if d.Max <= d.Min {
+		return d.Min
+	}
+
+	return d.Min + time.Duration(rand.Int63n(int64(d.Max-d.Min)))
+}
+
+type NormalDistribution struct {
+	Mean   time.Duration
+	StdDev time.Duration
+}
+
+func (d NormalDistribution) Sample() time.Duration {
+	return nonNegative(d.Mean + time.Duration(rand.NormFloat64()*float64(d.StdDev)))
+}
+
+type ExponentialDistribution struct {
+	Mean time.Duration
+}
+
+func (d ExponentialDistribution) Sample() time.Duration {
+	return time.Duration(rand.ExpFloat64() * float64(d.Mean))
+}
+
+type EmpiricalDistribution struct {
+	Samples []time.Duration
+}
+
+func (d EmpiricalDistribution) Sample() time.Duration {
+	return d.Samples[rand.Intn(len(d.Samples))]
+}
+
+// ParseDistribution parses a distribution spec of the form "kind:args":
+//
+//	uniform:500ms,1s
+//	normal:5s,500ms        (mean, standard deviation)
+//	exponential:5s         (mean)
+//	empirical:samples.csv  (every field is a sample)
+//
+// Durations without a unit are taken to be milliseconds.
+func ParseDistribution(spec string) (Distribution, error) {
+	segments := strings.SplitN(spec, ":", 2)
+	if len(segments) != 2 {
+		return nil, fmt.Errorf("invalid distribution: %s", spec)
+	}
+
+	kind, args := segments[0], segments[1]
+
+	if kind == "empirical" {
+		return loadEmpiricalDistribution(args)
+	}
+
+	durations, err := parseDurations(strings.Split(args, ","))
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case kind == "uniform" && len(durations) == 2:
+		return UniformDistribution{Min: durations[0], Max: durations[1]}, nil
+	case kind == "normal" && len(durations) == 2:
+		return NormalDistribution{Mean: durations[0], StdDev: durations[1]}, nil
+	case kind == "exponential" && len(durations) == 1:
+		return ExponentialDistribution{Mean: durations[0]}, nil
+	}
+
+	return nil, fmt.Errorf("invalid distribution: %s", spec)
+}
+
+func loadEmpiricalDistribution(path string) (Distribution, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	samples := []time.Duration{}
+
+	for _, record := range records {
+		durations, err := parseDurations(record)
+		if err != nil {
+			return nil, err
+		}
+
+		samples = append(samples, durations...)
+	}
+
+	if len(samples) == 0 {
+		return nil, ErrNoSamples
+	}
+
+	return EmpiricalDistribution{Samples: samples}, nil
+}
+
+func parseDurations(values []string) ([]time.Duration, error) {
+	durations := []time.Duration{}
+
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		milliseconds, err := strconv.ParseFloat(value, 64)
+		if err == nil {
+			durations = append(durations, time.Duration(milliseconds*float64(time.Millisecond)))
+			continue
+		}
+
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, err
+		}
+
+		durations = append(durations, duration)
+	}
+
+	return durations, nil
+}
+
+func nonNegative(duration time.Duration) time.Duration {
+	if duration < 0 {
+		return 0
+	}
+
+	return duration
+}
+
+// PhaseDistributions configures how long the executor spends in each
+// simulated phase of running a task.
+type PhaseDistributions struct {
+	Hesitate        Distribution
+	CreateContainer Distribution
+	Run             Distribution
+
+	overrides *overrideCache
+}
+
+type overrideCache struct {
+	parsed map[models.PhaseDurations]parsedOverride
+	lock   sync.Mutex
+}
+
+type parsedOverride struct {
+	phases PhaseDistributions
+	err    error
+}
+
+func NewPhaseDistributions(durations models.PhaseDurations) (PhaseDistributions, error) {
+	return PhaseDistributions{
+		overrides: &overrideCache{
+			parsed: map[models.PhaseDurations]parsedOverride{},
+		},
+	}.Override(durations)
+}
+
+// LoadPhaseDurations reads a JSON file of the same shape as a task's
+// phase_durations, e.g. {"run": "normal:5s,1s"}.
+func LoadPhaseDurations(path string) (models.PhaseDurations, error) {
+	var durations models.PhaseDurations
+
+	payload, err := ioutil.ReadFile(path)
+	if err != nil {
+		return durations, err
+	}
+
+	err = json.Unmarshal(payload, &durations)
+
+	return durations, err
+}
+
+// Override replaces any phase for which durations has a spec.
+func (d PhaseDistributions) Override(durations models.PhaseDurations) (PhaseDistributions, error) {
+	return d.override(durations, true)
+}
+
+func (d PhaseDistributions) override(durations models.PhaseDurations, allowEmpirical bool) (PhaseDistributions, error) {
+	var err error
+
+	if durations.Hesitate != "" {
+		d.Hesitate, err = parsePhaseDistribution(durations.Hesitate, allowEmpirical)
+		if err != nil {
+			return d, err
+		}
+	}
+
+	if durations.CreateContainer != "" {
+		d.CreateContainer, err = parsePhaseDistribution(durations.CreateContainer, allowEmpirical)
+		if err != nil {
+			return d, err
+		}
+	}
+
+	if durations.Run != "" {
+		d.Run, err = parsePhaseDistribution(durations.Run, allowEmpirical)
+		if err != nil {
+			return d, err
+		}
+	}
+
+	return d, nil
+}
+
+func parsePhaseDistribution(spec string, allowEmpirical bool) (Distribution, error) {
+	if !allowEmpirical && strings.HasPrefix(spec, "empirical:") {
+		return nil, ErrEmpiricalNotAllowed
+	}
+
+	return ParseDistribution(spec)
+}
+
+// ForTask applies the task's own phase durations, if it has any. Invalid
+// overrides are logged and ignored. Empirical distributions name a file on
+// the executor's disk, so a task may not ask for one.
+//
+// Parsed overrides are cached, so that asking again for the same task (once
+// per phase) does not parse them again.
+func (d PhaseDistributions) ForTask(task *models.Task) PhaseDistributions {
+	if task.PhaseDurations == nil {
+		return d
+	}
+
+	overridden, err := d.overrideForTask(*task.PhaseDurations)
+	if err != nil {
+		logger.Error("task.invalid-phase-durations", map[string]interface{}{
+			"task":  task.Guid,
+			"error": err.Error(),
+		})
+
+		return d
+	}
+
+	return overridden
+}
+
+func (d PhaseDistributions) overrideForTask(durations models.PhaseDurations) (PhaseDistributions, error) {
+	if d.overrides == nil {
+		return d.override(durations, false)
+	}
+
+	d.overrides.lock.Lock()
+	defer d.overrides.lock.Unlock()
+
+	cached, found := d.overrides.parsed[durations]
+	if found {
+		return cached.phases, cached.err
+	}
+
+	if len(d.overrides.parsed) >= maxCachedOverrides {
+		d.overrides.parsed = map[models.PhaseDurations]parsedOverride{}
+	}
+
+	phases, err := d.override(durations, false)
+
+	d.overrides.parsed[durations] = parsedOverride{
+		phases: phases,
+		err:    err,
+	}
+
+	return phases, err
+}
+
+func sleepForARandomInterval(reason string, distribution Distribution, data map[string]interface{}) {
+	duration := distribution.Sample()
+
+	data["duration"] = fmt.Sprintf("%s", duration)
+
+	logger.Info(reason, data)
+
+	time.Sleep(duration)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/onsi/ginkgo/cleanup"
+
+	"logger"
+	"runtime-schema/models"
+)
+
+// drainExecutor stops taking on work, gives running tasks until the drain
+// timeout to finish, hands any tasks that never got started back to other
+// executors, and exits.
+func drainExecutor(handler *Handler) {
+	drainOnce.Do(func() {
+		logger.Info("draining", map[string]interface{}{
+			"timeout": drainTimeout.String(),
+		})
+
+		handler.stopClaiming()
+
+		close(drain)
+
+		if !handler.waitForTasks(*drainTimeout) {
+			logger.Info("drain.timed-out", map[string]interface{}{})
+			handler.demoteClaimedTasks()
+		}
+
+		logger.Info("drained", map[string]interface{}{})
+
+		cleanup.Exit(0)
+	})
+}
+
+func (handler *Handler) drain(writer http.ResponseWriter, request *http.Request) {
+	go drainExecutor(handler)
+
+	writer.WriteHeader(http.StatusAccepted)
+}
+
+// beginClaim registers an in-flight claim, unless the executor is draining.
+// Every successful call must be matched by a call to endClaim.
+func (handler *Handler) beginClaim() bool {
+	handler.drainMutex.Lock()
+	defer handler.drainMutex.Unlock()
+
+	if handler.draining {
+		return false
+	}
+
+	handler.inFlight.Add(1)
+
+	return true
+}
+
+func (handler *Handler) endClaim() {
+	handler.inFlight.Done()
+}
+
+func (handler *Handler) stopClaiming() {
+	handler.drainMutex.Lock()
+	defer handler.drainMutex.Unlock()
+
+	handler.draining = true
+}
+
+func (handler *Handler) waitForTasks(timeout time.Duration) bool {
+	done := make(chan struct{})
+
+	go func() {
+		handler.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (handler *Handler) demoteClaimedTasks() {
+	handler.ownedTasksMutex.RLock()
+
+	claimed := []models.Task{}
+	for _, owned := range handler.ownedTasks {
+		if owned.Phase == TaskPhaseClaimed {
+			claimed = append(claimed, owned.Task)
+		}
+	}
+
+	handler.ownedTasksMutex.RUnlock()
+
+	for _, task := range claimed {
+		err := handler.bbs.DemoteTask(&task)
+		if err != nil {
+			logger.Error(storeFailure("drain.demote", err), map[string]interface{}{
+				"task":  task.Guid,
+				"error": err.Error(),
+			})
+
+			continue
+		}
+
+		logger.Info("drain.demoted", map[string]interface{}{
+			"task": task.Guid,
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io"
+
+	"runtime-schema/models"
+)
+
+// FakeBackend doesn't create anything; it just takes a while to do so, for
+// simulating scheduling without running real workloads.
+type FakeBackend struct {
+	phases PhaseDistributions
+}
+
+func NewFakeBackend(phases PhaseDistributions) *FakeBackend {
+	return &FakeBackend{
+		phases: phases,
+	}
+}
+
+func (backend *FakeBackend) Create(task *models.Task) (string, error) {
+	sleepForARandomInterval("task.create-container", backend.phases.ForTask(task).CreateContainer, map[string]interface{}{
+		"task": task.Guid,
+	})
+
+	return "fake-" + task.Guid, nil
+}
+
+func (backend *FakeBackend) Run(handle string, task *models.Task, output io.Writer, cancel <-chan struct{}) (string, error) {
+	finished := make(chan struct{})
+
+	go func() {
+		sleepForARandomInterval("task.run", backend.phases.ForTask(task).Run, map[string]interface{}{
+			"task": task.Guid,
+		})
+
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return "", nil
+	case <-cancel:
+		return "", ErrCancelled
+	}
+}
+
+func (backend *FakeBackend) Destroy(handle string) error {
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"time"
+
+	"logger"
+	"runtime-schema/models"
+)
+
+// FaultInjection makes the executor misbehave on purpose, so that the
+// convergence paths for failed, stuck, and orphaned tasks get exercised.
+// Each probability is rolled independently, per task (or per heartbeat, for
+// DropPresence).
+type FaultInjection struct {
+	// FailTask is the probability of failing a task after running it.
+	FailTask      float64 `json:"fail_task"`
+	FailureReason string  `json:"failure_reason"`
+
+	// StallClaimed is the probability of sitting on a claimed task for
+	// StallDuration before starting it. StallDuration is written as a
+	// duration string, e.g. "45s".
+	StallClaimed  float64       `json:"stall_claimed"`
+	StallDuration time.Duration `json:"stall_duration"`
+
+	// Crash is the probability of exiting the process while running a task.
+	Crash float64 `json:"crash"`
+
+	// DropPresence is the probability of removing the executor's presence
+	// on each heartbeat, while carrying on as if nothing happened.
+	DropPresence float64 `json:"drop_presence"`
+}
+
+func LoadFaultInjection(path string, faults FaultInjection) (FaultInjection, error) {
+	payload, err := ioutil.ReadFile(path)
+	if err != nil {
+		return faults, err
+	}
+
+	err = json.Unmarshal(payload, &faults)
+
+	return faults, err
+}
+
+type faultInjectionAlias FaultInjection
+
+// UnmarshalJSON reads stall_duration as a duration string, falling back to a
+// plain number of nanoseconds. Fields missing from the JSON keep their
+// current values.
+func (faults *FaultInjection) UnmarshalJSON(payload []byte) error {
+	var fields struct {
+		*faultInjectionAlias
+		StallDuration json.RawMessage `json:"stall_duration"`
+	}
+
+	fields.faultInjectionAlias = (*faultInjectionAlias)(faults)
+
+	err := json.Unmarshal(payload, &fields)
+	if err != nil {
+		return err
+	}
+
+	if fields.StallDuration == nil {
+		return nil
+	}
+
+	var duration string
+
+	err = json.Unmarshal(fields.StallDuration, &duration)
+	if err == nil {
+		stallDuration, err := time.ParseDuration(duration)
+		if err != nil {
+			return err
+		}
+
+		faults.StallDuration = stallDuration
+
+		return nil
+	}
+
+	var nanoseconds int64
+
+	err = json.Unmarshal(fields.StallDuration, &nanoseconds)
+	if err != nil {
+		return fmt.Errorf("invalid stall_duration: %s", fields.StallDuration)
+	}
+
+	faults.StallDuration = time.Duration(nanoseconds)
+
+	return nil
+}
+
+func (faults FaultInjection) ShouldFailTask(task *models.Task) bool {
+	return faults.roll("faults.fail-task", faults.FailTask, task)
+}
+
+func (faults FaultInjection) StallIfUnlucky(task *models.Task) {
+	if !faults.roll("faults.stall-claimed", faults.StallClaimed, task) {
+		return
+	}
+
+	time.Sleep(faults.StallDuration)
+}
+
+func (faults FaultInjection) CrashIfUnlucky(task *models.Task) {
+	if !faults.roll("faults.crash", faults.Crash, task) {
+		return
+	}
+
+	os.Exit(1)
+}
+
+func (faults FaultInjection) ShouldDropPresence() bool {
+	return faults.roll("faults.drop-presence", faults.DropPresence, nil)
+}
+
+func (faults FaultInjection) roll(fault string, probability float64, task *models.Task) bool {
+	if probability <= 0 || rand.Float64() >= probability {
+		return false
+	}
+
+	data := map[string]interface{}{}
+	if task != nil {
+		data["task"] = task.Guid
+	}
+
+	logger.Info(fault, data)
+
+	return true
+}
@@ -3,28 +3,79 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
-	"math/rand"
 	"net/http"
 	"sync"
-	"time"
 
 	"logger"
 	"runtime-schema/bbs"
 	"runtime-schema/models"
+	"runtime-schema/router"
 )
 
 type Handler struct {
-	bbs bbs.ExecutorBBS
-
-	currentMemory int
-	memoryMutex   *sync.Mutex
+	bbs     bbs.ExecutorBBS
+	backend ContainerBackend
+	phases  PhaseDistributions
+	faults  FaultInjection
+	stacks  []string
+
+	totalResources     models.ExecutorResources
+	remainingResources models.ExecutorResources
+	resourcesMutex     *sync.Mutex
+
+	ownedTasks      map[string]*OwnedTask
+	ownedTasksMutex *sync.RWMutex
+
+	inFlight   *sync.WaitGroup
+	draining   bool
+	drainMutex *sync.Mutex
 }
 
 var ErrAlreadyClaimed = errors.New("already claimed")
 var ErrNoCapacity = errors.New("no capacity")
 
-func (handler *Handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+// StatusWrongStack is returned when asked to run a task for a stack this
+// executor doesn't support, so that the hurler tries another executor.
+const StatusWrongStack = 422
+
+func NewHandler(
+	bbs bbs.ExecutorBBS,
+	backend ContainerBackend,
+	phases PhaseDistributions,
+	faults FaultInjection,
+	stacks []string,
+	resources models.ExecutorResources,
+) *Handler {
+	return &Handler{
+		bbs:     bbs,
+		backend: backend,
+		phases:  phases,
+		faults:  faults,
+		stacks:  stacks,
+
+		totalResources:     resources,
+		remainingResources: resources,
+		resourcesMutex:     &sync.Mutex{},
+
+		ownedTasks:      map[string]*OwnedTask{},
+		ownedTasksMutex: &sync.RWMutex{},
+
+		inFlight:   &sync.WaitGroup{},
+		drainMutex: &sync.Mutex{},
+	}
+}
+
+func (handler *Handler) Router() (http.Handler, error) {
+	return router.NewExecutorRoutes().Router(router.Handlers{
+		router.EXECUTOR_CLAIM_TASK: http.HandlerFunc(handler.claimTask),
+		router.EXECUTOR_CAPACITY:   http.HandlerFunc(handler.getCapacity),
+		router.EXECUTOR_LIST_TASKS: http.HandlerFunc(handler.listTasks),
+		router.EXECUTOR_GET_TASK:   http.HandlerFunc(handler.getTask),
+		router.EXECUTOR_DRAIN:      http.HandlerFunc(handler.drain),
+	})
+}
+
+func (handler *Handler) claimTask(writer http.ResponseWriter, request *http.Request) {
 	var task *models.Task
 
 	err := json.NewDecoder(request.Body).Decode(&task)
@@ -38,62 +89,126 @@ func (handler *Handler) ServeHTTP(writer http.ResponseWriter, request *http.Requ
 		return
 	}
 
-	sleepForARandomInterval("handler.hesitate", 0, 100, map[string]interface{}{
+	if !handler.supportsStack(task.Stack) {
+		logger.Info("handler.wrong-stack", map[string]interface{}{
+			"task":  task.Guid,
+			"stack": task.Stack,
+		})
+
+		writer.WriteHeader(StatusWrongStack)
+
+		return
+	}
+
+	sleepForARandomInterval("handler.hesitate", handler.phases.ForTask(task).Hesitate, map[string]interface{}{
 		"task": task.Guid,
 	})
 
-	ok := handler.reserveMemory(task.MemoryMB)
+	writer.WriteHeader(handler.claim(task))
+}
+
+// claim tries to take on the task, starting it running if successful. The
+// returned HTTP status says how it went: StatusCreated if claimed,
+// StatusServiceUnavailable if there's no room for it (or the executor is
+// draining, or the BBS timed out), or StatusConflict if it couldn't be
+// claimed in the BBS.
+func (handler *Handler) claim(task *models.Task) int {
+	if !handler.beginClaim() {
+		logger.Info("handler.draining", map[string]interface{}{
+			"task": task.Guid,
+		})
+
+		return http.StatusServiceUnavailable
+	}
+
+	ok := handler.reserveResources(task)
 	if !ok {
+		handler.endClaim()
+
 		logger.Info("handler.full", map[string]interface{}{
 			"task": task.Guid,
 		})
 
-		writer.WriteHeader(http.StatusServiceUnavailable)
-
-		return
+		return http.StatusServiceUnavailable
 	}
 
 	logger.Info("claiming.runonce", map[string]interface{}{
 		"task": task.Guid,
 	})
 
-	err = handler.bbs.ClaimTask(task, executorID)
+	err := handler.bbs.ClaimTask(task, executorID)
+	if timedOut(err) {
+		handler.releaseResources(task)
+		handler.endClaim()
+
+		// if the claim went through after all, convergence will demote it
+		logger.Error("handler.claim-timed-out", map[string]interface{}{
+			"task":  task.Guid,
+			"error": err.Error(),
+		})
+
+		return http.StatusServiceUnavailable
+	}
+
 	if err != nil {
-		handler.releaseMemory(task.MemoryMB)
+		handler.releaseResources(task)
+		handler.endClaim()
 
 		logger.Info("handler.claim-failed", map[string]interface{}{
 			"task":  task.Guid,
 			"error": err.Error(),
 		})
 
-		writer.WriteHeader(http.StatusConflict)
-
-		return
+		return http.StatusConflict
 	}
 
-	go handler.runTask(task)
+	owned := handler.trackTask(task)
 
-	writer.WriteHeader(http.StatusCreated)
+	go handler.runTask(task, owned)
+
+	return http.StatusCreated
 }
 
-func (handler *Handler) runTask(task *models.Task) {
-	defer handler.releaseMemory(task.MemoryMB)
+func (handler *Handler) runTask(task *models.Task, owned *OwnedTask) {
+	defer handler.endClaim()
+	defer handler.releaseResources(task)
+	defer handler.untrackTask(owned)
 
 	logger.Info("task.claimed", map[string]interface{}{
 		"task": task.Guid,
 	})
 
-	sleepForARandomInterval("task.create-container", 500, 1000, map[string]interface{}{
-		"task": task.Guid,
-	})
+	handler.faults.StallIfUnlucky(task)
+
+	handle, err := handler.backend.Create(task)
+	if err != nil {
+		logger.Error("task.create-container-failed", map[string]interface{}{
+			"task":  task.Guid,
+			"error": err.Error(),
+		})
+
+		handler.failTask(task, owned, "failed to create container: "+err.Error())
+		return
+	}
+
+	defer handler.destroyContainer(task, handle)
+
+	if handler.completeIfCancelled(task, owned) {
+		return
+	}
 
 	logger.Info("task.start", map[string]interface{}{
-		"task": task.Guid,
+		"task":      task.Guid,
+		"container": handle,
 	})
 
-	err := handler.bbs.StartTask(task, "container")
+	err = handler.bbs.StartTask(task, handle)
 	if err != nil {
-		logger.Error("task.start-failed", map[string]interface{}{
+		if handler.completeIfCancelled(task, owned) {
+			return
+		}
+
+		logger.Error(storeFailure("task.start", err), map[string]interface{}{
 			"task":  task.Guid,
 			"error": err.Error(),
 		})
@@ -101,17 +216,44 @@ func (handler *Handler) runTask(task *models.Task) {
 		return
 	}
 
-	sleepForARandomInterval("task.run", 5000, 5001, map[string]interface{}{
-		"task": task.Guid,
-	})
+	handler.updateTask(owned, task, TaskPhaseRunning)
+
+	handler.faults.CrashIfUnlucky(task)
+
+	result, err := handler.backend.Run(handle, task, taskOutput{task}, owned.cancel)
+	if err == ErrCancelled {
+		handler.completeIfCancelled(task, owned)
+		return
+	}
+
+	if err != nil {
+		logger.Error("task.run-failed", map[string]interface{}{
+			"task":  task.Guid,
+			"error": err.Error(),
+		})
+
+		handler.failTask(task, owned, err.Error())
+		return
+	}
+
+	if handler.faults.ShouldFailTask(task) {
+		handler.failTask(task, owned, handler.faults.FailureReason)
+		return
+	}
 
 	logger.Info("task.completing", map[string]interface{}{
 		"task": task.Guid,
 	})
 
-	err = handler.bbs.CompleteTask(task, false, "", "")
+	handler.updateTask(owned, task, TaskPhaseCompleting)
+
+	err = handler.bbs.CompleteTask(task, false, "", result)
 	if err != nil {
-		logger.Error("task.complete-failed", map[string]interface{}{
+		if handler.completeIfCancelled(task, owned) {
+			return
+		}
+
+		logger.Error(storeFailure("task.complete", err), map[string]interface{}{
 			"task":  task.Guid,
 			"error": err.Error(),
 		})
@@ -124,32 +266,105 @@ func (handler *Handler) runTask(task *models.Task) {
 	})
 }
 
-func (handler *Handler) reserveMemory(memory int) bool {
-	handler.memoryMutex.Lock()
-	defer handler.memoryMutex.Unlock()
+func (handler *Handler) destroyContainer(task *models.Task, handle string) {
+	err := handler.backend.Destroy(handle)
+	if err != nil {
+		logger.Error("task.destroy-container-failed", map[string]interface{}{
+			"task":      task.Guid,
+			"container": handle,
+			"error":     err.Error(),
+		})
+	}
+}
+
+func (handler *Handler) failTask(task *models.Task, owned *OwnedTask, reason string) {
+	logger.Info("task.failing", map[string]interface{}{
+		"task":   task.Guid,
+		"reason": reason,
+	})
+
+	handler.updateTask(owned, task, TaskPhaseCompleting)
+
+	err := handler.bbs.CompleteTask(task, true, reason, "")
+	if err != nil {
+		if handler.completeIfCancelled(task, owned) {
+			return
+		}
 
-	if handler.currentMemory >= memory {
-		handler.currentMemory = handler.currentMemory - memory
+		logger.Error(storeFailure("task.complete", err), map[string]interface{}{
+			"task":  task.Guid,
+			"error": err.Error(),
+		})
+	}
+}
+
+func timedOut(err error) bool {
+	_, isTimeout := err.(bbs.StoreTimeoutError)
+	return isTimeout
+}
+
+// storeFailure names the log subject for a failed BBS operation, telling
+// timeouts (where the outcome is unknown) apart from outright failures.
+func storeFailure(operation string, err error) string {
+	if timedOut(err) {
+		return operation + "-timed-out"
+	}
+
+	return operation + "-failed"
+}
+
+// supportsStack reports whether tasks for the given stack can run here. Tasks
+// that don't specify a stack can run anywhere.
+func (handler *Handler) supportsStack(stack string) bool {
+	if stack == "" {
 		return true
 	}
 
+	for _, supported := range handler.stacks {
+		if supported == stack {
+			return true
+		}
+	}
+
 	return false
 }
 
-func (handler *Handler) releaseMemory(memory int) {
-	handler.memoryMutex.Lock()
-	defer handler.memoryMutex.Unlock()
+func (handler *Handler) reserveResources(task *models.Task) bool {
+	handler.resourcesMutex.Lock()
+	defer handler.resourcesMutex.Unlock()
 
-	handler.currentMemory = handler.currentMemory + memory
-}
+	remaining := handler.remainingResources
+
+	if remaining.MemoryMB < task.MemoryMB {
+		return false
+	}
+
+	if remaining.DiskMB < task.DiskMB {
+		return false
+	}
 
-func sleepForARandomInterval(reason string, minSleepTime, maxSleepTime int, data map[string]interface{}) {
-	interval := rand.Intn(maxSleepTime-minSleepTime) + minSleepTime
-	duration := time.Duration(interval) * time.Millisecond
+	if remaining.FileDescriptors < task.FileDescriptors {
+		return false
+	}
+
+	handler.remainingResources = models.ExecutorResources{
+		MemoryMB:        remaining.MemoryMB - task.MemoryMB,
+		DiskMB:          remaining.DiskMB - task.DiskMB,
+		FileDescriptors: remaining.FileDescriptors - task.FileDescriptors,
+	}
 
-	data["duration"] = fmt.Sprintf("%s", duration)
+	return true
+}
+
+func (handler *Handler) releaseResources(task *models.Task) {
+	handler.resourcesMutex.Lock()
+	defer handler.resourcesMutex.Unlock()
 
-	logger.Info(reason, data)
+	remaining := handler.remainingResources
 
-	time.Sleep(duration)
+	handler.remainingResources = models.ExecutorResources{
+		MemoryMB:        remaining.MemoryMB + task.MemoryMB,
+		DiskMB:          remaining.DiskMB + task.DiskMB,
+		FileDescriptors: remaining.FileDescriptors + task.FileDescriptors,
+	}
 }
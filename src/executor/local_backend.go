@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"runtime-schema/models"
+)
+
+// LocalBackend runs tasks as local processes, each confined to a scratch
+// directory under baseDir. The directory's path is the container handle.
+type LocalBackend struct {
+	baseDir string
+}
+
+func NewLocalBackend(baseDir string) *LocalBackend {
+	return &LocalBackend{
+		baseDir: baseDir,
+	}
+}
+
+func (backend *LocalBackend) Create(task *models.Task) (string, error) {
+	return ioutil.TempDir(backend.baseDir, "task-"+task.Guid)
+}
+
+func (backend *LocalBackend) Run(handle string, task *models.Task, output io.Writer, cancel <-chan struct{}) (string, error) {
+	return performActions(task, handle, output, cancel)
+}
+
+func (backend *LocalBackend) Destroy(handle string) error {
+	if filepath.Dir(handle) != filepath.Clean(backend.baseDir) {
+		return ErrUnknownContainer
+	}
+
+	return os.RemoveAll(handle)
+}
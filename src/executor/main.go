@@ -7,9 +7,12 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
+	"os"
+	"os/signal"
 	"runtime"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/cloudfoundry/gunk/timeprovider"
@@ -22,6 +25,7 @@ import (
 
 	"logger"
 	"runtime-schema/bbs"
+	"runtime-schema/models"
 )
 
 var listenAddr = flag.String(
@@ -71,6 +75,18 @@ var convergenceInterval = flag.Duration(
 	"the interval between convergences",
 )
 
+var convergenceBatchSize = flag.Int(
+	"convergenceBatchSize",
+	bbs.DefaultConvergenceOptions.BatchSize,
+	"the number of tasks converged before waiting for their kicks and updates to finish",
+)
+
+var convergenceWorkers = flag.Int(
+	"convergenceWorkers",
+	bbs.DefaultConvergenceOptions.Workers,
+	"the number of concurrent kicks and updates during convergence",
+)
+
 var timeToClaimTask = flag.Duration(
 	"timeToClaimTask",
 	30*time.Minute,
@@ -83,14 +99,143 @@ var maxMemory = flag.Int(
 	"maximum memory capacity",
 )
 
+var maxDisk = flag.Int(
+	"diskMB",
+	10000,
+	"maximum disk capacity",
+)
+
+var maxFileDescriptors = flag.Int(
+	"maxFileDescriptors",
+	10000,
+	"maximum number of file descriptors",
+)
+
+var tempDir = flag.String(
+	"tempDir",
+	os.TempDir(),
+	"location to create per-task scratch directories",
+)
+
+var containerBackend = flag.String(
+	"containerBackend",
+	"fake",
+	"container backend to run tasks with (fake, local)",
+)
+
+var hesitateDuration = flag.String(
+	"hesitateDuration",
+	"uniform:0,100ms",
+	"distribution of time to wait before claiming a task (uniform:min,max, normal:mean,stddev, exponential:mean, empirical:file.csv)",
+)
+
+var createContainerDuration = flag.String(
+	"createContainerDuration",
+	"uniform:500ms,1s",
+	"distribution of time taken to create a fake container",
+)
+
+var runDuration = flag.String(
+	"runDuration",
+	"uniform:5s,5001ms",
+	"distribution of time taken to run a task in a fake container",
+)
+
+var phaseDurationsConfig = flag.String(
+	"phaseDurationsConfig",
+	"",
+	"JSON file of phase duration distributions, overriding the flags (e.g. {\"run\": \"exponential:5s\"})",
+)
+
+var failTaskProbability = flag.Float64(
+	"failTaskProbability",
+	0,
+	"probability of failing a task after running it",
+)
+
+var failTaskReason = flag.String(
+	"failTaskReason",
+	"injected failure",
+	"failure reason for tasks failed by fault injection",
+)
+
+var stallClaimedProbability = flag.Float64(
+	"stallClaimedProbability",
+	0,
+	"probability of stalling on a claimed task before starting it",
+)
+
+var stallClaimedDuration = flag.Duration(
+	"stallClaimedDuration",
+	45*time.Second,
+	"how long to stall on a claimed task; should exceed the 30s demotion window",
+)
+
+var crashProbability = flag.Float64(
+	"crashProbability",
+	0,
+	"probability of exiting while running a task",
+)
+
+var dropPresenceProbability = flag.Float64(
+	"dropPresenceProbability",
+	0,
+	"probability of dropping presence on each heartbeat",
+)
+
+var faultInjectionConfig = flag.String(
+	"faultInjectionConfig",
+	"",
+	"JSON file of fault injection probabilities, overriding the flags (e.g. {\"fail_task\": 0.1})",
+)
+
+var stacks = flag.String(
+	"stacks",
+	"lucid64",
+	"comma-separated list of stacks this executor supports",
+)
+
+var drainTimeout = flag.Duration(
+	"drainTimeout",
+	5*time.Minute,
+	"how long to wait for running tasks to finish when draining",
+)
+
+var claimMode = flag.String(
+	"claimMode",
+	"push",
+	"how the executor learns about tasks: 'push' to be handed them by the hurler, 'watch' to watch the BBS for them",
+)
+
+var claimJitter = flag.Duration(
+	"claimJitter",
+	100*time.Millisecond,
+	"in watch mode, the maximum random delay before claiming a task (doubled on each retry)",
+)
+
+var claimAttempts = flag.Int(
+	"claimAttempts",
+	5,
+	"in watch mode, how many times to try claiming a task while full",
+)
+
 var stop = make(chan bool)
+var drain = make(chan bool)
+var drainOnce = &sync.Once{}
 var tasks = &sync.WaitGroup{}
 var once = &sync.Once{}
 
 var executorID string
 
+// version is advertised in the executor's presence; override it at build
+// time with -ldflags "-X main.version <version>".
+var version = "dev"
+
 var MaintainPresenceError = errors.New("failed to maintain presence")
 
+// how many guids of each kind a convergence's log message lists
+const convergenceSampleSize = 10
+
 func main() {
 	var err error
 
@@ -152,29 +297,88 @@ func main() {
 		})
 	}
 
-	bbs := bbs.New(bbs.NewHurlerKicker(*hurlerAddress), etcdAdapter, timeprovider.NewTimeProvider())
+	phases, err := phaseDistributions()
+	if err != nil {
+		logger.Fatal("phase-durations.invalid", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
 
-	ready := make(chan bool, 1)
+	backend, err := NewContainerBackend(*containerBackend, phases)
+	if err != nil {
+		logger.Fatal("container-backend.invalid", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
 
-	err = maintainPresence(bbs, ready)
+	faults, err := faultInjection()
 	if err != nil {
-		logger.Fatal("initializing-presence", map[string]interface{}{
+		logger.Fatal("fault-injection.invalid", map[string]interface{}{
 			"error": err.Error(),
 		})
 	}
 
-	err = registerHandler(etcdAdapter, *listenAddr, ready)
+	var kicker bbs.Kicker = bbs.NewHurlerKicker(*hurlerAddress)
+
+	switch *claimMode {
+	case "push":
+	case "watch":
+		kicker = bbs.NewStoreKicker(etcdAdapter, kicker)
+	default:
+		logger.Fatal("claim-mode.invalid", map[string]interface{}{
+			"mode": *claimMode,
+		})
+	}
+
+	bbs := bbs.New(kicker, etcdAdapter, timeprovider.NewTimeProvider())
+
+	supportedStacks := strings.Split(*stacks, ",")
+
+	handler := NewHandler(bbs, backend, phases, faults, supportedStacks, models.ExecutorResources{
+		MemoryMB:        *maxMemory,
+		DiskMB:          *maxDisk,
+		FileDescriptors: *maxFileDescriptors,
+	})
+
+	ready := make(chan bool, 1)
+
+	err = maintainPresence(bbs, handler, faults, ready)
 	if err != nil {
-		logger.Fatal("initializing-route", map[string]interface{}{
+		logger.Fatal("initializing-presence", map[string]interface{}{
 			"error": err.Error(),
 		})
 	}
 
-	go handleTasks(bbs, *listenAddr)
+	// in watch mode the hurler has no business handing us tasks
+	routeHosts := []string{}
+	if *claimMode == "push" {
+		routeHosts = executorRouteHosts(supportedStacks)
+	}
+
+	for _, host := range routeHosts {
+		err = registerHandler(etcdAdapter, host, *listenAddr, ready)
+		if err != nil {
+			logger.Fatal("initializing-route", map[string]interface{}{
+				"host":  host,
+				"error": err.Error(),
+			})
+		}
+	}
+
+	go handleTasks(handler, *listenAddr)
 	go convergeTasks(bbs)
+	go drainOnSignal(handler)
+	go watchForCancellations(bbs, handler)
+
+	if *claimMode == "watch" {
+		go watchForDesiredTasks(bbs, handler)
+	}
 
 	<-ready
-	<-ready
+
+	for _ = range routeHosts {
+		<-ready
+	}
 
 	logger.Info("up", map[string]interface{}{
 		"executor": executorID,
@@ -183,8 +387,19 @@ func main() {
 	select {}
 }
 
-func maintainPresence(bbs bbs.ExecutorBBS, ready chan<- bool) error {
-	p, statusChannel, err := bbs.MaintainExecutorPresence(*heartbeatInterval, executorID)
+func maintainPresence(bbs bbs.ExecutorBBS, handler *Handler, faults FaultInjection, ready chan<- bool) error {
+	p, statusChannel, err := bbs.MaintainExecutorPresence(*heartbeatInterval, executorID, func() models.ExecutorPresence {
+		capacity := handler.Capacity()
+
+		return models.ExecutorPresence{
+			ExecutorID: executorID,
+			Address:    *listenAddr,
+			Stacks:     handler.stacks,
+			Total:      capacity.Total,
+			Available:  capacity.Remaining,
+			Version:    version,
+		}
+	})
 	if err != nil {
 		ready <- false
 		return err
@@ -192,7 +407,12 @@ func maintainPresence(bbs bbs.ExecutorBBS, ready chan<- bool) error {
 
 	tasks.Add(1)
 
+	heartbeat := time.NewTicker(*heartbeatInterval)
+	dropped := false
+
 	go func() {
+		defer heartbeat.Stop()
+
 		for {
 			select {
 			case locked, ok := <-statusChannel:
@@ -201,7 +421,7 @@ func maintainPresence(bbs bbs.ExecutorBBS, ready chan<- bool) error {
 					ready = nil
 				}
 
-				if !locked && ok {
+				if !locked && ok && !dropped {
 					tasks.Done()
 					logger.Fatal("maintain.presence.fatal", map[string]interface{}{})
 				}
@@ -211,6 +431,12 @@ func maintainPresence(bbs bbs.ExecutorBBS, ready chan<- bool) error {
 					return
 				}
 
+			case <-heartbeat.C:
+				if !dropped && faults.ShouldDropPresence() {
+					dropped = true
+					p.Remove()
+				}
+
 			case <-stop:
 				p.Remove()
 
@@ -227,19 +453,76 @@ func maintainPresence(bbs bbs.ExecutorBBS, ready chan<- bool) error {
 	return nil
 }
 
-func handleTasks(bbs bbs.ExecutorBBS, listenAddr string) {
-	err := http.ListenAndServe(listenAddr, &Handler{
-		bbs: bbs,
+func drainOnSignal(handler *Handler) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
 
-		currentMemory: *maxMemory,
-		memoryMutex:   &sync.Mutex{},
-	})
+	<-signals
+
+	drainExecutor(handler)
+}
+
+func handleTasks(handler *Handler, listenAddr string) {
+	router, err := handler.Router()
+	if err != nil {
+		logger.Fatal("handler.invalid", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+
+	err = http.ListenAndServe(listenAddr, router)
 
 	logger.Fatal("handling.failed", map[string]interface{}{
 		"error": err.Error(),
 	})
 }
 
+func phaseDistributions() (PhaseDistributions, error) {
+	phases, err := NewPhaseDistributions(models.PhaseDurations{
+		Hesitate:        *hesitateDuration,
+		CreateContainer: *createContainerDuration,
+		Run:             *runDuration,
+	})
+	if err != nil {
+		return phases, err
+	}
+
+	if *phaseDurationsConfig == "" {
+		return phases, nil
+	}
+
+	durations, err := LoadPhaseDurations(*phaseDurationsConfig)
+	if err != nil {
+		return phases, err
+	}
+
+	return phases.Override(durations)
+}
+
+func faultInjection() (FaultInjection, error) {
+	faults := FaultInjection{
+		FailTask:      *failTaskProbability,
+		FailureReason: *failTaskReason,
+		StallClaimed:  *stallClaimedProbability,
+		StallDuration: *stallClaimedDuration,
+		Crash:         *crashProbability,
+		DropPresence:  *dropPresenceProbability,
+	}
+
+	if *faultInjectionConfig == "" {
+		return faults, nil
+	}
+
+	return LoadFaultInjection(*faultInjectionConfig, faults)
+}
+
+func convergenceOptions() bbs.ConvergenceOptions {
+	return bbs.ConvergenceOptions{
+		BatchSize: *convergenceBatchSize,
+		Workers:   *convergenceWorkers,
+	}
+}
+
 func convergeTasks(bbs bbs.ExecutorBBS) {
 	statusChannel, releaseLock, err := bbs.MaintainConvergeLock(*convergenceInterval, executorID)
 	if err != nil {
@@ -260,10 +543,20 @@ func convergeTasks(bbs bbs.ExecutorBBS) {
 
 				logger.Info("converging", map[string]interface{}{})
 
-				bbs.ConvergeTasks(*timeToClaimTask)
+				report, err := bbs.ConvergeTasks(*timeToClaimTask, convergenceOptions())
+				if err != nil {
+					logger.Error("converge.failed", map[string]interface{}{
+						"error": err.Error(),
+					})
 
+					continue
+				}
+
+				// the full report can outgrow a NATS message
 				logger.Info("converged", map[string]interface{}{
-					"took": time.Since(t),
+					"took":   time.Since(t),
+					"counts": report.Counts(),
+					"sample": report.Sample(convergenceSampleSize),
 				})
 			} else {
 				logger.Info("converge-lock.lost", map[string]interface{}{})
@@ -279,9 +572,19 @@ func convergeTasks(bbs bbs.ExecutorBBS) {
 	}
 }
 
-func registerHandler(etcdAdapter *etcdstoreadapter.ETCDStoreAdapter, addr string, ready chan<- bool) error {
+func executorRouteHosts(stacks []string) []string {
+	hosts := []string{bbs.ExecutorRouteHost("")}
+
+	for _, stack := range stacks {
+		hosts = append(hosts, bbs.ExecutorRouteHost(stack))
+	}
+
+	return hosts
+}
+
+func registerHandler(etcdAdapter *etcdstoreadapter.ETCDStoreAdapter, host string, addr string, ready chan<- bool) error {
 	node := storeadapter.StoreNode{
-		Key: "/v1/routes/round-robin/executor/" + addr,
+		Key: "/v1/routes/round-robin/" + host + "/" + addr,
 		TTL: 60,
 	}
 
@@ -311,6 +614,16 @@ func registerHandler(etcdAdapter *etcdstoreadapter.ETCDStoreAdapter, addr string
 					return
 				}
 
+			case <-drain:
+				close(clearNode)
+
+				for _ = range status {
+				}
+
+				tasks.Done()
+
+				return
+
 			case <-stop:
 				close(clearNode)
 
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+
+	"logger"
+	"runtime-schema/bbs"
+	"runtime-schema/models"
+)
+
+// watchForDesiredTasks claims pending tasks as they show up in the BBS,
+// rather than waiting for the hurler to hand them over.
+func watchForDesiredTasks(bbs bbs.ExecutorBBS, handler *Handler) {
+	for {
+		desiredTasks, stopWatching, errs := bbs.WatchForDesiredTask()
+
+	watching:
+		for {
+			select {
+			case task, ok := <-desiredTasks:
+				if !ok {
+					break watching
+				}
+
+				if !handler.supportsStack(task.Stack) {
+					continue
+				}
+
+				go handler.claimWithBackoff(task)
+
+			case err, ok := <-errs:
+				if ok {
+					logger.Error("desired.watch-failed", map[string]interface{}{
+						"error": err.Error(),
+					})
+				}
+
+				break watching
+
+			case <-drain:
+				close(stopWatching)
+				return
+
+			case <-stop:
+				close(stopWatching)
+				return
+			}
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// claimWithBackoff waits a random interval of up to claimJitter before trying
+// to claim the task, so that every executor watching doesn't go for it at
+// once. If there's no room for it, the interval doubles and it tries again,
+// up to claimAttempts times. Each attempt claims a fresh copy of the task as
+// it was desired, as a failed claim leaves its copy transitioned.
+func (handler *Handler) claimWithBackoff(task *models.Task) {
+	backoff := *claimJitter
+
+	for attempt := 0; attempt < *claimAttempts; attempt++ {
+		if backoff > 0 {
+			time.Sleep(time.Duration(rand.Int63n(int64(backoff))))
+		}
+
+		claim := *task
+
+		if handler.claim(&claim) != http.StatusServiceUnavailable {
+			return
+		}
+
+		backoff *= 2
+	}
+
+	logger.Info("desired.gave-up", map[string]interface{}{
+		"task":     task.Guid,
+		"attempts": *claimAttempts,
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"logger"
+)
+
+// DropletUploader streams droplets to disk. Each droplet is written to a
+// temporary file in tempDirectory, outside of what is served, and renamed
+// into directory once complete, so a droplet is either fully present or not
+// at all.
+type DropletUploader struct {
+	directory     string
+	tempDirectory string
+	maxSize       int64
+}
+
+func NewDropletUploader(directory string, tempDirectory string, maxSize int64) *DropletUploader {
+	return &DropletUploader{
+		directory:     directory,
+		tempDirectory: tempDirectory,
+		maxSize:       maxSize,
+	}
+}
+
+func (uploader *DropletUploader) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	guid := request.URL.Query().Get(":guid")
+
+	if guid == "" || guid == "." || guid == ".." || guid != filepath.Base(guid) {
+		logger.Info("droplet.invalid-guid", map[string]interface{}{
+			"guid": guid,
+		})
+
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if request.ContentLength > uploader.maxSize {
+		logger.Info("droplet.too-large", map[string]interface{}{
+			"guid": guid,
+			"size": request.ContentLength,
+		})
+
+		writer.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	tempFile, err := ioutil.TempFile(uploader.tempDirectory, "upload-")
+	if err != nil {
+		logger.Error("droplet.create-failed", map[string]interface{}{
+			"guid":  guid,
+			"error": err.Error(),
+		})
+
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	defer os.Remove(tempFile.Name())
+
+	// read one byte past the limit, to tell a droplet of exactly maxSize
+	// apart from one that's too large
+	written, err := io.Copy(tempFile, io.LimitReader(request.Body, uploader.maxSize+1))
+	tempFile.Close()
+
+	if err != nil {
+		logger.Error("droplet.upload-failed", map[string]interface{}{
+			"guid":  guid,
+			"error": err.Error(),
+		})
+
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if written > uploader.maxSize {
+		logger.Info("droplet.too-large", map[string]interface{}{
+			"guid": guid,
+			"size": written,
+		})
+
+		writer.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	err = os.Rename(tempFile.Name(), filepath.Join(uploader.directory, guid))
+	if err != nil {
+		logger.Error("droplet.rename-failed", map[string]interface{}{
+			"guid":  guid,
+			"error": err.Error(),
+		})
+
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("droplet.uploaded", map[string]interface{}{
+		"guid": guid,
+		"size": written,
+	})
+
+	writer.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/gunk/timeprovider"
+	"github.com/cloudfoundry/storeadapter/etcdstoreadapter"
+	"github.com/cloudfoundry/storeadapter/workerpool"
+	"github.com/cloudfoundry/yagnats"
+	"github.com/onsi/ginkgo/cleanup"
+
+	"logger"
+	"runtime-schema/bbs"
+	"runtime-schema/router"
+)
+
+var listenAddr = flag.String(
+	"listenAddr",
+	"0.0.0.0:8080",
+	"listening address for the file server",
+)
+
+var serverURL = flag.String(
+	"serverURL",
+	"http://127.0.0.1:8080",
+	"URL at which others can reach this file server",
+)
+
+var fileServerID = flag.String(
+	"fileServerID",
+	"file-server-id",
+	"the file server's ID",
+)
+
+var staticDirectory = flag.String(
+	"staticDirectory",
+	"",
+	"directory to serve under /static/; droplets are written to its droplets subdirectory",
+)
+
+var maxDropletSizeMB = flag.Int64(
+	"maxDropletSizeMB",
+	1024,
+	"largest droplet that may be uploaded",
+)
+
+var heartbeatInterval = flag.Duration(
+	"heartbeatInterval",
+	60*time.Second,
+	"the interval between heartbeats for maintaining presence",
+)
+
+var etcdCluster = flag.String(
+	"etcdCluster",
+	"http://127.0.0.1:4001",
+	"comma-separated list of etcd URIs (http://ip:port)",
+)
+
+var natsAddresses = flag.String(
+	"natsAddresses",
+	"127.0.0.1:4222",
+	"comma-separated list of NATS addresses (ip:port)",
+)
+
+var natsUsername = flag.String(
+	"natsUsername",
+	"nats",
+	"Username to connect to nats",
+)
+
+var natsPassword = flag.String(
+	"natsPassword",
+	"nats",
+	"Password for nats user",
+)
+
+var stop = make(chan bool)
+var tasks = &sync.WaitGroup{}
+var once = &sync.Once{}
+
+func main() {
+	flag.Parse()
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+
+	cleanup.Register(func() {
+		once.Do(func() {
+			logger.Info("shutting-down", map[string]interface{}{})
+			close(stop)
+			tasks.Wait()
+			logger.Info("shutdown", map[string]interface{}{})
+		})
+	})
+
+	natsMembers := []yagnats.ConnectionProvider{}
+
+	for _, addr := range strings.Split(*natsAddresses, ",") {
+		natsMembers = append(
+			natsMembers,
+			&yagnats.ConnectionInfo{
+				Addr:     addr,
+				Username: *natsUsername,
+				Password: *natsPassword,
+			},
+		)
+	}
+
+	err := logger.Connect(&yagnats.ConnectionCluster{Members: natsMembers})
+	if err != nil {
+		log.Fatalln("could not connect logger:", err)
+	}
+
+	logger.Component = fmt.Sprintf("file-server.%s", *fileServerID)
+
+	if *staticDirectory == "" {
+		logger.Fatal("static-directory.unspecified", map[string]interface{}{})
+	}
+
+	dropletDirectory := filepath.Join(*staticDirectory, "droplets")
+
+	err = os.MkdirAll(dropletDirectory, 0755)
+	if err != nil {
+		logger.Fatal("droplet-directory.create-failed", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+
+	// partial uploads must not be served, so they go beside the static
+	// directory rather than in it (but on the same filesystem, to be renamed)
+	uploadDirectory := filepath.Clean(*staticDirectory) + ".uploads"
+
+	err = os.MkdirAll(uploadDirectory, 0755)
+	if err != nil {
+		logger.Fatal("upload-directory.create-failed", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+
+	etcdAdapter := etcdstoreadapter.NewETCDStoreAdapter(
+		strings.Split(*etcdCluster, ","),
+		workerpool.NewWorkerPool(10),
+	)
+	err = etcdAdapter.Connect()
+	if err != nil {
+		logger.Fatal("etcd-connect", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+
+	bbs := bbs.New(bbs.NopKicker{}, etcdAdapter, timeprovider.NewTimeProvider())
+
+	handler, err := router.NewFileServerRoutes().Router(router.Handlers{
+		router.FS_STATIC:         http.StripPrefix("/static/", http.FileServer(http.Dir(*staticDirectory))),
+		router.FS_UPLOAD_DROPLET: NewDropletUploader(dropletDirectory, uploadDirectory, *maxDropletSizeMB*1024*1024),
+	})
+	if err != nil {
+		logger.Fatal("router.failed", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+
+	go serve(handler)
+
+	ready := make(chan bool, 1)
+
+	err = maintainPresence(bbs, ready)
+	if err != nil {
+		logger.Fatal("maintain.presence.failed", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+
+	if !<-ready {
+		logger.Fatal("maintain.presence.failed", map[string]interface{}{})
+	}
+
+	logger.Info("up", map[string]interface{}{
+		"file-server": *fileServerID,
+		"url":         *serverURL,
+	})
+
+	select {}
+}
+
+func serve(handler http.Handler) {
+	err := http.ListenAndServe(*listenAddr, handler)
+
+	logger.Fatal("serving.failed", map[string]interface{}{
+		"error": err.Error(),
+	})
+}
+
+func maintainPresence(bbs bbs.FileServerBBS, ready chan<- bool) error {
+	p, statusChannel, err := bbs.MaintainFileServerPresence(*heartbeatInterval, *serverURL, *fileServerID)
+	if err != nil {
+		return err
+	}
+
+	tasks.Add(1)
+
+	go func() {
+		for {
+			select {
+			case locked, ok := <-statusChannel:
+				if locked && ready != nil {
+					ready <- true
+					ready = nil
+				}
+
+				if !locked && ok {
+					tasks.Done()
+					logger.Fatal("maintain.presence.fatal", map[string]interface{}{})
+				}
+
+				if !ok {
+					tasks.Done()
+					return
+				}
+
+			case <-stop:
+				p.Remove()
+
+				for _ = range statusChannel {
+				}
+
+				tasks.Done()
+
+				return
+			}
+		}
+	}()
+
+	return nil
+}
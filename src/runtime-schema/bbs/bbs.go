@@ -22,20 +22,29 @@ type ExecutorBBS interface {
 	MaintainExecutorPresence(
 		heartbeatInterval time.Duration,
 		executorID string,
+		status func() models.ExecutorPresence,
 	) (presence Presence, disappeared <-chan bool, err error)
 
+	GetAllExecutorPresences() ([]models.ExecutorPresence, error)
+
 	ClaimTask(task *models.Task, executorID string) error
 	StartTask(task *models.Task, containerHandle string) error
 	CompleteTask(task *models.Task, failed bool, failureReason string, result string) error
+	DemoteTask(task *models.Task) error
+
+	WatchForDesiredTask() (<-chan *models.Task, chan<- bool, <-chan error)
+	WatchForCancelledTask() (<-chan *models.Task, chan<- bool, <-chan error)
 
-	ConvergeTasks(timeToClaim time.Duration)
+	ConvergeTasks(timeToClaim time.Duration, options ConvergenceOptions) (models.ConvergenceReport, error)
 	MaintainConvergeLock(interval time.Duration, executorID string) (disappeared <-chan bool, stop chan<- chan bool, err error)
 }
 
 type StagerBBS interface {
 	DesireTask(*models.Task) error
+	DesireTaskIdempotently(*models.Task) error
 	ResolvingTask(*models.Task) error
 	ResolveTask(*models.Task) error
+	CancelTask(guid string) error
 
 	GetAvailableFileServer() (string, error)
 }
@@ -48,17 +57,36 @@ type FileServerBBS interface {
 	) (presence Presence, disappeared <-chan bool, err error)
 }
 
+// Config tunes a BBS beyond its defaults.
+type Config struct {
+	RetryPolicy RetryPolicy
+
+	// the stacks desired tasks may ask for; nil allows any stack
+	KnownStacks []string
+}
+
+var DefaultConfig = Config{
+	RetryPolicy: DefaultRetryPolicy,
+}
+
 func New(kicker Kicker, store storeadapter.StoreAdapter, timeProvider timeprovider.TimeProvider) *BBS {
+	return NewWithConfig(kicker, store, timeProvider, DefaultConfig)
+}
+
+func NewWithConfig(kicker Kicker, store storeadapter.StoreAdapter, timeProvider timeprovider.TimeProvider, config Config) *BBS {
 	return &BBS{
 		ExecutorBBS: &executorBBS{
 			store:        store,
 			timeProvider: timeProvider,
+			retryPolicy:  config.RetryPolicy,
 			kicker:       kicker,
 		},
 
 		StagerBBS: &stagerBBS{
 			store:        store,
 			timeProvider: timeProvider,
+			retryPolicy:  config.RetryPolicy,
+			knownStacks:  config.KnownStacks,
 			kicker:       kicker,
 		},
 
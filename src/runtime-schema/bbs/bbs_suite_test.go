@@ -0,0 +1,54 @@
+package bbs_test
+
+import (
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"runtime-schema/models"
+
+	"testing"
+)
+
+func TestBbs(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Bbs Suite")
+}
+
+// fakeKicker records the guids of the tasks it is asked to kick. Convergence
+// kicks from several goroutines at once.
+type fakeKicker struct {
+	desired   []string
+	completed []string
+
+	lock sync.Mutex
+}
+
+func (kicker *fakeKicker) Desire(task *models.Task) {
+	kicker.lock.Lock()
+	defer kicker.lock.Unlock()
+
+	kicker.desired = append(kicker.desired, task.Guid)
+}
+
+func (kicker *fakeKicker) Complete(task *models.Task) {
+	kicker.lock.Lock()
+	defer kicker.lock.Unlock()
+
+	kicker.completed = append(kicker.completed, task.Guid)
+}
+
+func (kicker *fakeKicker) Desired() []string {
+	kicker.lock.Lock()
+	defer kicker.lock.Unlock()
+
+	return append([]string{}, kicker.desired...)
+}
+
+func (kicker *fakeKicker) Completed() []string {
+	kicker.lock.Lock()
+	defer kicker.lock.Unlock()
+
+	return append([]string{}, kicker.completed...)
+}
@@ -22,6 +22,10 @@ func (self *BBS) GetAllCompletedTasks() ([]*models.Task, error) {
 	return getAllTasks(self.store, models.TaskStateCompleted)
 }
 
+func (self *BBS) GetAllResolvingTasks() ([]*models.Task, error) {
+	return getAllTasks(self.store, models.TaskStateResolving)
+}
+
 func (self *BBS) GetAllExecutors() ([]string, error) {
 	nodes, err := self.store.ListRecursively(ExecutorSchemaRoot)
 	if err == storeadapter.ErrorKeyNotFound {
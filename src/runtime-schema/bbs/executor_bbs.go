@@ -1,11 +1,13 @@
 package bbs
 
 import (
+	"sync"
 	"time"
 
 	"github.com/cloudfoundry/gosteno"
 	"github.com/cloudfoundry/gunk/timeprovider"
 	"github.com/cloudfoundry/storeadapter"
+	"github.com/cloudfoundry/storeadapter/workerpool"
 
 	"runtime-schema/models"
 )
@@ -13,82 +15,101 @@ import (
 type executorBBS struct {
 	store        storeadapter.StoreAdapter
 	timeProvider timeprovider.TimeProvider
+	retryPolicy  RetryPolicy
 
 	kicker Kicker
 }
 
-func (self *executorBBS) MaintainExecutorPresence(heartbeatInterval time.Duration, executorId string) (Presence, <-chan bool, error) {
-	presence := NewPresence(self.store, executorSchemaPath(executorId), []byte{})
-	status, err := presence.Maintain(heartbeatInterval)
-	return presence, status, err
+// The executor calls this to announce itself. status is consulted on every
+// heartbeat, so the advertised capacity stays current.
+func (self *executorBBS) MaintainExecutorPresence(heartbeatInterval time.Duration, executorId string, status func() models.ExecutorPresence) (Presence, <-chan bool, error) {
+	presence := NewHeartbeatPresence(self.store, executorSchemaPath(executorId), func() []byte {
+		return status().ToJSON()
+	})
+	disappeared, err := presence.Maintain(heartbeatInterval)
+	return presence, disappeared, err
+}
+
+func (self *executorBBS) GetAllExecutorPresences() ([]models.ExecutorPresence, error) {
+	node, err := self.store.ListRecursively(ExecutorSchemaRoot)
+	if err == storeadapter.ErrorKeyNotFound {
+		return []models.ExecutorPresence{}, nil
+	}
+
+	if err != nil {
+		return []models.ExecutorPresence{}, err
+	}
+
+	presences := []models.ExecutorPresence{}
+	for _, node := range node.ChildNodes {
+		presence, err := models.NewExecutorPresenceFromJSON(node.Value)
+		if err != nil {
+			gosteno.NewLogger("bbs").Errorf("cannot parse executor presence JSON for key %s: %s", node.Key, err.Error())
+		} else {
+			presences = append(presences, presence)
+		}
+	}
+
+	return presences, nil
 }
 
 // The executor calls this when it wants to claim a runonce
-// stagerBBS will retry this repeatedly if it gets a StoreTimeout error (up to N seconds?)
+// stagerBBS will retry this if it gets a StoreTimeout error, as its RetryPolicy allows
 // If this fails, the executor should assume that someone else is handling the claim and should bail
 func (self *executorBBS) ClaimTask(task *models.Task, executorID string) error {
 	originalValue := task.ToJSON()
 
-	task.UpdatedAt = self.timeProvider.Time().UnixNano()
+	err := task.TransitionTo(models.TaskStateClaimed)
+	if err != nil {
+		return err
+	}
 
-	task.State = models.TaskStateClaimed
+	task.UpdatedAt = self.timeProvider.Time().UnixNano()
 	task.ExecutorID = executorID
 
-	return retryIndefinitelyOnStoreTimeout(func() error {
-		return self.store.CompareAndSwap(storeadapter.StoreNode{
-			Key:   taskSchemaPath(task),
-			Value: originalValue,
-		}, storeadapter.StoreNode{
-			Key:   taskSchemaPath(task),
-			Value: task.ToJSON(),
-		})
+	return self.retryPolicy.retryOnStoreTimeout(func() error {
+		return compareAndSwapTask(self.store, originalValue, task)
 	})
 }
 
 // The executor calls this when it is about to run the runonce in the claimed container
-// stagerBBS will retry this repeatedly if it gets a StoreTimeout error (up to N seconds?)
+// stagerBBS will retry this if it gets a StoreTimeout error, as its RetryPolicy allows
 // If this fails, the executor should assume that someone else is running and should clean up and bail
 func (self *executorBBS) StartTask(task *models.Task, containerHandle string) error {
 	originalValue := task.ToJSON()
 
-	task.UpdatedAt = self.timeProvider.Time().UnixNano()
+	err := task.TransitionTo(models.TaskStateRunning)
+	if err != nil {
+		return err
+	}
 
-	task.State = models.TaskStateRunning
+	task.UpdatedAt = self.timeProvider.Time().UnixNano()
 	task.ContainerHandle = containerHandle
 
-	return retryIndefinitelyOnStoreTimeout(func() error {
-		return self.store.CompareAndSwap(storeadapter.StoreNode{
-			Key:   taskSchemaPath(task),
-			Value: originalValue,
-		}, storeadapter.StoreNode{
-			Key:   taskSchemaPath(task),
-			Value: task.ToJSON(),
-		})
+	return self.retryPolicy.retryOnStoreTimeout(func() error {
+		return compareAndSwapTask(self.store, originalValue, task)
 	})
 }
 
 // The executor calls this when it has finished running the runonce (be it success or failure)
-// stagerBBS will retry this repeatedly if it gets a StoreTimeout error (up to N seconds?)
+// stagerBBS will retry this if it gets a StoreTimeout error, as its RetryPolicy allows
 // This really really shouldn't fail.  If it does, blog about it and walk away. If it failed in a
 // consistent way (i.e. key already exists), there's probably a flaw in our design.
 func (self *executorBBS) CompleteTask(task *models.Task, failed bool, failureReason string, result string) error {
 	originalValue := task.ToJSON()
 
-	task.UpdatedAt = self.timeProvider.Time().UnixNano()
+	err := task.TransitionTo(models.TaskStateCompleted)
+	if err != nil {
+		return err
+	}
 
-	task.State = models.TaskStateCompleted
+	task.UpdatedAt = self.timeProvider.Time().UnixNano()
 	task.Failed = failed
 	task.FailureReason = failureReason
 	task.Result = result
 
-	return retryIndefinitelyOnStoreTimeout(func() error {
-		err := self.store.CompareAndSwap(storeadapter.StoreNode{
-			Key:   taskSchemaPath(task),
-			Value: originalValue,
-		}, storeadapter.StoreNode{
-			Key:   taskSchemaPath(task),
-			Value: task.ToJSON(),
-		})
+	return self.retryPolicy.retryOnStoreTimeout(func() error {
+		err := compareAndSwapTask(self.store, originalValue, task)
 		if err != nil {
 			return err
 		}
@@ -99,6 +120,76 @@ func (self *executorBBS) CompleteTask(task *models.Task, failed bool, failureRea
 	})
 }
 
+// The executor calls this when it is giving up on a runonce it has claimed but not started (e.g. when draining)
+// stagerBBS will retry this if it gets a StoreTimeout error, as its RetryPolicy allows
+// If this fails, the runonce has already moved on (e.g. convergence demoted it) and the executor can forget about it
+func (self *executorBBS) DemoteTask(task *models.Task) error {
+	originalValue := task.ToJSON()
+
+	err := task.TransitionTo(models.TaskStatePending)
+	if err != nil {
+		return err
+	}
+
+	*task = demoteToPending(*task)
+	task.UpdatedAt = self.timeProvider.Time().UnixNano()
+
+	return self.retryPolicy.retryOnStoreTimeout(func() error {
+		err := compareAndSwapTask(self.store, originalValue, task)
+		if err != nil {
+			return err
+		}
+
+		self.kicker.Desire(task)
+
+		return nil
+	})
+}
+
+// The executor calls this to learn about runonces it could claim, instead of waiting to be kicked
+func (self *executorBBS) WatchForDesiredTask() (<-chan *models.Task, chan<- bool, <-chan error) {
+	return watchForTaskModifications(self.store, func(task models.Task) bool {
+		return task.State == models.TaskStatePending
+	})
+}
+
+// The executor calls this to learn about runonces the stager wants cancelled
+// Only Claimed and Running runonces are reported; the executor should abort any it owns
+func (self *executorBBS) WatchForCancelledTask() (<-chan *models.Task, chan<- bool, <-chan error) {
+	return watchForTaskModifications(self.store, func(task models.Task) bool {
+		if !task.CancelRequested {
+			return false
+		}
+
+		return task.State == models.TaskStateClaimed || task.State == models.TaskStateRunning
+	})
+}
+
+// ConvergenceOptions bounds how much work a single convergence does at once.
+type ConvergenceOptions struct {
+	// run-onces examined before waiting for their kicks and swaps to finish
+	BatchSize int
+
+	// kicks and swaps performed concurrently
+	Workers int
+}
+
+var DefaultConvergenceOptions = ConvergenceOptions{
+	BatchSize: 500,
+	Workers:   20,
+}
+
+type convergenceReporter struct {
+	report models.ConvergenceReport
+	lock   *sync.Mutex
+}
+
+func (reporter *convergenceReporter) record(guids *[]string, guid string) {
+	reporter.lock.Lock()
+	*guids = append(*guids, guid)
+	reporter.lock.Unlock()
+}
+
 // ConvergeTasks is run by *one* executor every X seconds (doesn't really matter what X is.. pick something performant)
 // Converge will:
 // 1. Kick (by setting) any run-onces that are still pending
@@ -107,44 +198,109 @@ func (self *executorBBS) CompleteTask(task *models.Task, failed bool, failureRea
 // 4. Demote to completed any resolving run-onces that have been resolving for > 30s
 // 5. Mark as failed any run-onces that have been in the pending state for > timeToClaim
 // 6. Mark as failed any claimed or running run-onces whose executor has stopped maintaining presence
-func (self *executorBBS) ConvergeTasks(timeToClaim time.Duration) {
-	taskState, err := self.store.ListRecursively(TaskSchemaRoot)
-	if err != nil {
-		return
+// 7. Mark as cancelled any claimed or running run-onces whose cancellation the executor hasn't recorded
+// Run-onces are listed one shard at a time, then processed options.BatchSize at a time, with kicks and swaps spread over options.Workers
+// The returned report says which run-onces were acted on
+func (self *executorBBS) ConvergeTasks(timeToClaim time.Duration, options ConvergenceOptions) (models.ConvergenceReport, error) {
+	started := time.Now()
+
+	reporter := &convergenceReporter{
+		report: models.ConvergenceReport{
+			StartedAt: started.UnixNano(),
+		},
+		lock: &sync.Mutex{},
 	}
 
 	executorState, err := self.store.ListRecursively(ExecutorSchemaRoot)
 	if err == storeadapter.ErrorKeyNotFound {
 		executorState = storeadapter.StoreNode{}
 	} else if err != nil {
-		return
+		return reporter.report, err
 	}
 
-	logger := gosteno.NewLogger("bbs")
-	logError := func(task models.Task, message string) {
-		logger.Errord(map[string]interface{}{
-			"runonce": task,
-		}, message)
+	workers := options.Workers
+	if workers <= 0 {
+		workers = 1
 	}
 
+	pool := workerpool.NewWorkerPool(workers)
+	defer pool.StopWorkers()
+
+	for shard := 0; shard < TaskShards; shard++ {
+		nodes, err := listTaskShard(self.store, shard)
+		if err != nil {
+			return reporter.report, err
+		}
+
+		batchSize := options.BatchSize
+		if batchSize <= 0 {
+			batchSize = len(nodes)
+		}
+
+		for start := 0; start < len(nodes); start += batchSize {
+			end := start + batchSize
+			if end > len(nodes) {
+				end = len(nodes)
+			}
+
+			self.convergeBatch(nodes[start:end], executorState, timeToClaim, pool, reporter)
+		}
+	}
+
+	reporter.report.Duration = int64(time.Since(started))
+
+	return reporter.report, nil
+}
+
+func (self *executorBBS) convergeBatch(
+	nodes []storeadapter.StoreNode,
+	executorState storeadapter.StoreNode,
+	timeToClaim time.Duration,
+	pool *workerpool.WorkerPool,
+	reporter *convergenceReporter,
+) {
+	report := &reporter.report
+
 	keysToDelete := []string{}
 	unclaimedTimeoutBoundary := self.timeProvider.Time().Add(-timeToClaim).UnixNano()
 
-	tasksToCAS := [][]models.Task{}
-	scheduleForCAS := func(oldTask, newTask models.Task) {
-		tasksToCAS = append(tasksToCAS, []models.Task{
-			oldTask,
-			newTask,
+	wg := &sync.WaitGroup{}
+
+	kick := func(send func(*models.Task), task models.Task, kicked *[]string) {
+		reporter.record(kicked, task.Guid)
+
+		wg.Add(1)
+		pool.ScheduleWork(func() {
+			defer wg.Done()
+			send(&task)
+		})
+	}
+
+	scheduleForCAS := func(node storeadapter.StoreNode, oldTask, newTask models.Task, affected *[]string) {
+		// every branch below makes a legal move; this guards against
+		// the table and the branches drifting apart
+		if !oldTask.State.CanTransitionTo(newTask.State) {
+			reporter.record(&report.IllegalTransitions, oldTask.Guid)
+			return
+		}
+
+		wg.Add(1)
+		pool.ScheduleWork(func() {
+			defer wg.Done()
+
+			if self.compareAndSwapNode(node, newTask) {
+				reporter.record(affected, oldTask.Guid)
+			} else {
+				reporter.record(&report.CompareAndSwapFailed, oldTask.Guid)
+			}
 		})
 	}
 
-	for _, node := range taskState.ChildNodes {
+	for _, node := range nodes {
+		report.Examined++
+
 		task, err := models.NewTaskFromJSON(node.Value)
 		if err != nil {
-			logger.Errord(map[string]interface{}{
-				"key":   node.Key,
-				"value": string(node.Value),
-			}, "runonce.converge.json-parse-failure")
 			keysToDelete = append(keysToDelete, node.Key)
 			continue
 		}
@@ -152,74 +308,59 @@ func (self *executorBBS) ConvergeTasks(timeToClaim time.Duration) {
 		switch task.State {
 		case models.TaskStatePending:
 			if task.CreatedAt <= unclaimedTimeoutBoundary {
-				logError(task, "runonce.converge.failed-to-claim")
-				scheduleForCAS(task, markTaskFailed(task, "not claimed within time limit"))
+				scheduleForCAS(node, task, markTaskFailed(task, TaskUnclaimedReason), &report.FailedToClaim)
 			} else {
-				go self.kicker.Desire(&task)
+				kick(self.kicker.Desire, task, &report.KickedPending)
 			}
 		case models.TaskStateClaimed:
 			claimedTooLong := self.timeProvider.Time().Sub(time.Unix(0, task.UpdatedAt)) >= 30*time.Second
 			_, executorIsAlive := executorState.Lookup(task.ExecutorID)
 
-			if !executorIsAlive {
-				logError(task, "runonce.converge.executor-disappeared")
-				scheduleForCAS(task, markTaskFailed(task, "executor disappeared before completion"))
+			if task.CancelRequested {
+				scheduleForCAS(node, task, markTaskFailed(task, TaskCancelledReason), &report.Cancelled)
+			} else if !executorIsAlive {
+				scheduleForCAS(node, task, markTaskFailed(task, TaskExecutorDisappearedReason), &report.ExecutorDisappeared)
 			} else if claimedTooLong {
-				logError(task, "runonce.converge.failed-to-start")
-				scheduleForCAS(task, demoteToPending(task))
+				scheduleForCAS(node, task, demoteToPending(task), &report.DemotedToPending)
 			}
 		case models.TaskStateRunning:
 			_, executorIsAlive := executorState.Lookup(task.ExecutorID)
 
-			if !executorIsAlive {
-				logError(task, "runonce.converge.executor-disappeared")
-				scheduleForCAS(task, markTaskFailed(task, "executor disappeared before completion"))
+			if task.CancelRequested {
+				scheduleForCAS(node, task, markTaskFailed(task, TaskCancelledReason), &report.Cancelled)
+			} else if !executorIsAlive {
+				scheduleForCAS(node, task, markTaskFailed(task, TaskExecutorDisappearedReason), &report.ExecutorDisappeared)
 			}
 		case models.TaskStateCompleted:
-			go self.kicker.Complete(&task)
+			kick(self.kicker.Complete, task, &report.KickedCompleted)
 		case models.TaskStateResolving:
 			resolvingTooLong := self.timeProvider.Time().Sub(time.Unix(0, task.UpdatedAt)) >= 30*time.Second
 
 			if resolvingTooLong {
-				logError(task, "runonce.converge.failed-to-resolve")
-				scheduleForCAS(task, demoteToCompleted(task))
+				scheduleForCAS(node, task, demoteToCompleted(task), &report.DemotedToCompleted)
 			}
 		}
 	}
 
-	self.batchCompareAndSwapTasks(tasksToCAS, logger)
-	self.store.Delete(keysToDelete...)
-}
-
-func (self *executorBBS) batchCompareAndSwapTasks(tasksToCAS [][]models.Task, logger *gosteno.Logger) {
-	done := make(chan struct{}, len(tasksToCAS))
+	wg.Wait()
 
-	for _, taskPair := range tasksToCAS {
-		originalStoreNode := storeadapter.StoreNode{
-			Key:   taskSchemaPath(&taskPair[0]),
-			Value: taskPair[0].ToJSON(),
-		}
+	if len(keysToDelete) > 0 {
+		self.store.Delete(keysToDelete...)
+		report.DeletedMalformed = append(report.DeletedMalformed, keysToDelete...)
+	}
+}
 
-		taskPair[1].UpdatedAt = self.timeProvider.Time().UnixNano()
-		newStoreNode := storeadapter.StoreNode{
-			Key:   taskSchemaPath(&taskPair[1]),
-			Value: taskPair[1].ToJSON(),
-		}
+// compareAndSwapNode swaps against the node exactly as listed, so tasks whose
+// stored encoding differs from ours (e.g. legacy numeric states) still match.
+func (self *executorBBS) compareAndSwapNode(oldNode storeadapter.StoreNode, newTask models.Task) bool {
+	newTask.UpdatedAt = self.timeProvider.Time().UnixNano()
 
-		go func() {
-			err := self.store.CompareAndSwap(originalStoreNode, newStoreNode)
-			if err != nil {
-				logger.Errord(map[string]interface{}{
-					"error": err.Error(),
-				}, "runonce.converge.failed-to-compare-and-swap")
-			}
-			done <- struct{}{}
-		}()
-	}
+	err := self.store.CompareAndSwap(oldNode, storeadapter.StoreNode{
+		Key:   TaskSchemaPath(newTask.Guid),
+		Value: newTask.ToJSON(),
+	})
 
-	for _ = range tasksToCAS {
-		<-done
-	}
+	return err == nil
 }
 
 func markTaskFailed(task models.Task, reason string) models.Task {
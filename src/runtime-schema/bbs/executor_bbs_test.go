@@ -0,0 +1,678 @@
+package bbs_test
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/gunk/timeprovider/faketimeprovider"
+	"github.com/cloudfoundry/storeadapter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "runtime-schema/bbs"
+	"runtime-schema/bbs/inmemorystore"
+	"runtime-schema/models"
+)
+
+// meddlingStore lets a test change the store just before the next
+// compare-and-swap or compare-and-delete, as a racing executor or stager
+// would. It also records which keys are listed.
+type meddlingStore struct {
+	*inmemorystore.InMemoryStore
+
+	meddle func()
+	listed []string
+}
+
+func (store *meddlingStore) meddleOnce() {
+	if store.meddle != nil {
+		meddle := store.meddle
+		store.meddle = nil
+		meddle()
+	}
+}
+
+func (store *meddlingStore) ListRecursively(key string) (storeadapter.StoreNode, error) {
+	store.listed = append(store.listed, key)
+	return store.InMemoryStore.ListRecursively(key)
+}
+
+func (store *meddlingStore) CompareAndSwap(oldNode storeadapter.StoreNode, newNode storeadapter.StoreNode) error {
+	store.meddleOnce()
+	return store.InMemoryStore.CompareAndSwap(oldNode, newNode)
+}
+
+func (store *meddlingStore) CompareAndDelete(nodes ...storeadapter.StoreNode) error {
+	store.meddleOnce()
+	return store.InMemoryStore.CompareAndDelete(nodes...)
+}
+
+var _ = Describe("Executor BBS", func() {
+	var timeProvider *faketimeprovider.FakeTimeProvider
+	var store *meddlingStore
+	var kicker *fakeKicker
+	var bbs *BBS
+	var task *models.Task
+
+	storedTask := func(guid string) models.Task {
+		node, err := store.Get(TaskSchemaPath(guid))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		task, err := models.NewTaskFromJSON(node.Value)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return task
+	}
+
+	presentExecutor := func(executorID string) {
+		err := store.SetMulti([]storeadapter.StoreNode{
+			{Key: ExecutorSchemaRoot + "/" + executorID, Value: []byte("{}")},
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		timeProvider = &faketimeprovider.FakeTimeProvider{
+			TimeToProvide: time.Unix(1238, 0),
+		}
+
+		store = &meddlingStore{InMemoryStore: inmemorystore.New(timeProvider)}
+		kicker = &fakeKicker{}
+		bbs = New(kicker, store, timeProvider)
+
+		task = &models.Task{
+			Guid: "some-guid",
+			Actions: []models.ExecutorAction{
+				{Action: models.RunAction{Script: "true"}},
+			},
+		}
+	})
+
+	Describe("ClaimTask", func() {
+		Context("when the task is pending", func() {
+			BeforeEach(func() {
+				err := bbs.DesireTask(task)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				timeProvider.IncrementBySeconds(1)
+			})
+
+			It("claims it for the executor", func() {
+				err := bbs.ClaimTask(task, "executor-id")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				claimed := storedTask("some-guid")
+				Ω(claimed.State).Should(Equal(models.TaskStateClaimed))
+				Ω(claimed.ExecutorID).Should(Equal("executor-id"))
+				Ω(claimed.UpdatedAt).Should(Equal(timeProvider.Time().UnixNano()))
+				Ω(claimed).Should(Equal(*task))
+			})
+
+			Context("when another executor claims it first", func() {
+				It("fails, leaving the other executor's claim", func() {
+					otherExecutorsCopy := *task
+
+					err := bbs.ClaimTask(&otherExecutorsCopy, "other-executor-id")
+					Ω(err).ShouldNot(HaveOccurred())
+
+					err = bbs.ClaimTask(task, "executor-id")
+					Ω(err).Should(Equal(storeadapter.ErrorKeyComparisonFailed))
+
+					Ω(storedTask("some-guid").ExecutorID).Should(Equal("other-executor-id"))
+				})
+			})
+		})
+
+		Context("when the task was stored with a numeric state", func() {
+			BeforeEach(func() {
+				legacy := models.Task{
+					Guid: "legacy-guid",
+					Actions: []models.ExecutorAction{
+						{Action: models.RunAction{Script: "true"}},
+					},
+					State:     models.TaskStatePending,
+					CreatedAt: timeProvider.Time().UnixNano(),
+				}
+
+				err := store.SetMulti([]storeadapter.StoreNode{
+					{
+						Key:   TaskSchemaPath("legacy-guid"),
+						Value: []byte(strings.Replace(string(legacy.ToJSON()), `"state":"pending"`, `"state":1`, 1)),
+					},
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			It("claims it all the same", func() {
+				pending, err := bbs.GetAllPendingTasks()
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(pending).Should(HaveLen(1))
+
+				err = bbs.ClaimTask(pending[0], "executor-id")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				claimed := storedTask("legacy-guid")
+				Ω(claimed.State).Should(Equal(models.TaskStateClaimed))
+				Ω(claimed.ExecutorID).Should(Equal("executor-id"))
+			})
+
+			It("can still be failed by convergence", func() {
+				timeProvider.IncrementBySeconds(60)
+
+				report, err := bbs.ConvergeTasks(time.Minute, DefaultConvergenceOptions)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(report.FailedToClaim).Should(Equal([]string{"legacy-guid"}))
+				Ω(storedTask("legacy-guid").State).Should(Equal(models.TaskStateCompleted))
+			})
+		})
+
+		Context("when the task is not pending", func() {
+			BeforeEach(func() {
+				err := bbs.DesireTask(task)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = bbs.ClaimTask(task, "executor-id")
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			It("refuses the transition without touching the task", func() {
+				err := bbs.ClaimTask(task, "other-executor-id")
+				Ω(err).Should(Equal(models.IllegalTransitionError{
+					From: models.TaskStateClaimed,
+					To:   models.TaskStateClaimed,
+				}))
+
+				Ω(task.ExecutorID).Should(Equal("executor-id"))
+				Ω(storedTask("some-guid").ExecutorID).Should(Equal("executor-id"))
+			})
+		})
+
+		Context("when the task does not exist", func() {
+			It("fails", func() {
+				task.State = models.TaskStatePending
+
+				err := bbs.ClaimTask(task, "executor-id")
+				Ω(err).Should(Equal(storeadapter.ErrorKeyNotFound))
+			})
+		})
+	})
+
+	Describe("StartTask", func() {
+		BeforeEach(func() {
+			err := bbs.DesireTask(task)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		Context("when the task is claimed", func() {
+			BeforeEach(func() {
+				err := bbs.ClaimTask(task, "executor-id")
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			It("marks it as running in the container", func() {
+				err := bbs.StartTask(task, "container-handle")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				running := storedTask("some-guid")
+				Ω(running.State).Should(Equal(models.TaskStateRunning))
+				Ω(running.ContainerHandle).Should(Equal("container-handle"))
+			})
+
+			Context("when the task has been demoted in the meantime", func() {
+				It("fails", func() {
+					demoted := *task
+
+					err := bbs.DemoteTask(&demoted)
+					Ω(err).ShouldNot(HaveOccurred())
+
+					err = bbs.StartTask(task, "container-handle")
+					Ω(err).Should(Equal(storeadapter.ErrorKeyComparisonFailed))
+
+					Ω(storedTask("some-guid").State).Should(Equal(models.TaskStatePending))
+				})
+			})
+		})
+
+		Context("when the task is pending", func() {
+			It("refuses the transition", func() {
+				err := bbs.StartTask(task, "container-handle")
+				Ω(err).Should(BeAssignableToTypeOf(models.IllegalTransitionError{}))
+
+				Ω(storedTask("some-guid").State).Should(Equal(models.TaskStatePending))
+			})
+		})
+	})
+
+	Describe("CompleteTask", func() {
+		BeforeEach(func() {
+			err := bbs.DesireTask(task)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = bbs.ClaimTask(task, "executor-id")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		Context("when the task is running", func() {
+			BeforeEach(func() {
+				err := bbs.StartTask(task, "container-handle")
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			It("records the outcome and kicks the completion", func() {
+				err := bbs.CompleteTask(task, true, "it broke", "a result")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				completed := storedTask("some-guid")
+				Ω(completed.State).Should(Equal(models.TaskStateCompleted))
+				Ω(completed.Failed).Should(BeTrue())
+				Ω(completed.FailureReason).Should(Equal("it broke"))
+				Ω(completed.Result).Should(Equal("a result"))
+
+				Ω(kicker.Completed()).Should(Equal([]string{"some-guid"}))
+			})
+
+			Context("when the task has changed in the meantime", func() {
+				It("fails without kicking", func() {
+					store.meddle = func() {
+						cancelled := *task
+						cancelled.CancelRequested = true
+
+						err := store.Update(storeadapter.StoreNode{
+							Key:   TaskSchemaPath("some-guid"),
+							Value: cancelled.ToJSON(),
+						})
+						Ω(err).ShouldNot(HaveOccurred())
+					}
+
+					err := bbs.CompleteTask(task, false, "", "a result")
+					Ω(err).Should(Equal(storeadapter.ErrorKeyComparisonFailed))
+
+					Ω(kicker.Completed()).Should(BeEmpty())
+				})
+			})
+
+			Context("when a retried desire has pointed the task at a new inbox", func() {
+				BeforeEach(func() {
+					err := bbs.DesireTaskIdempotently(&models.Task{
+						Guid: "some-guid",
+						Actions: []models.ExecutorAction{
+							{Action: models.RunAction{Script: "true"}},
+						},
+						ReplyTo: "another-inbox",
+					})
+					Ω(err).ShouldNot(HaveOccurred())
+				})
+
+				It("completes it all the same, for the new inbox", func() {
+					err := bbs.CompleteTask(task, false, "", "a result")
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(task.ReplyTo).Should(Equal("another-inbox"))
+
+					completed := storedTask("some-guid")
+					Ω(completed.State).Should(Equal(models.TaskStateCompleted))
+					Ω(completed.ReplyTo).Should(Equal("another-inbox"))
+
+					Ω(kicker.Completed()).Should(Equal([]string{"some-guid"}))
+				})
+			})
+		})
+
+		Context("when the task is claimed but not started", func() {
+			It("completes it, e.g. when the container could not be created", func() {
+				err := bbs.CompleteTask(task, true, "failed to create container", "")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(storedTask("some-guid").State).Should(Equal(models.TaskStateCompleted))
+			})
+		})
+	})
+
+	Describe("DemoteTask", func() {
+		BeforeEach(func() {
+			err := bbs.DesireTask(task)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = bbs.ClaimTask(task, "executor-id")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("puts the task back up for grabs and kicks it", func() {
+			err := bbs.DemoteTask(task)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			demoted := storedTask("some-guid")
+			Ω(demoted.State).Should(Equal(models.TaskStatePending))
+			Ω(demoted.ExecutorID).Should(BeEmpty())
+
+			Ω(kicker.Desired()).Should(Equal([]string{"some-guid", "some-guid"}))
+		})
+
+		Context("when the task has started", func() {
+			It("refuses the transition", func() {
+				err := bbs.StartTask(task, "container-handle")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = bbs.DemoteTask(task)
+				Ω(err).Should(BeAssignableToTypeOf(models.IllegalTransitionError{}))
+			})
+		})
+	})
+
+	Describe("WatchForDesiredTask", func() {
+		It("reports tasks as they become pending", func() {
+			tasks, stop, _ := bbs.WatchForDesiredTask()
+			defer close(stop)
+
+			err := bbs.DesireTask(task)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			var desired *models.Task
+			Eventually(tasks).Should(Receive(&desired))
+			Ω(desired.Guid).Should(Equal("some-guid"))
+
+			err = bbs.ClaimTask(task, "executor-id")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Consistently(tasks).ShouldNot(Receive())
+		})
+	})
+
+	Describe("WatchForCancelledTask", func() {
+		It("reports claimed tasks once the stager cancels them", func() {
+			tasks, stop, _ := bbs.WatchForCancelledTask()
+			defer close(stop)
+
+			err := bbs.DesireTask(task)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = bbs.ClaimTask(task, "executor-id")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Consistently(tasks).ShouldNot(Receive())
+
+			err = bbs.CancelTask(task.Guid)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			var cancelled *models.Task
+			Eventually(tasks).Should(Receive(&cancelled))
+			Ω(cancelled.Guid).Should(Equal("some-guid"))
+			Ω(cancelled.CancelRequested).Should(BeTrue())
+		})
+	})
+
+	Describe("ConvergeTasks", func() {
+		timeToClaim := time.Minute
+
+		converge := func() models.ConvergenceReport {
+			report, err := bbs.ConvergeTasks(timeToClaim, DefaultConvergenceOptions)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			return report
+		}
+
+		BeforeEach(func() {
+			err := bbs.DesireTask(task)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			kicker.desired = nil
+		})
+
+		Context("when a task is pending", func() {
+			It("kicks it", func() {
+				report := converge()
+
+				Ω(report.Examined).Should(Equal(1))
+				Ω(report.KickedPending).Should(Equal([]string{"some-guid"}))
+				Ω(kicker.Desired()).Should(Equal([]string{"some-guid"}))
+			})
+
+			Context("for longer than timeToClaim", func() {
+				BeforeEach(func() {
+					timeProvider.IncrementBySeconds(60)
+				})
+
+				It("fails it as unclaimed", func() {
+					report := converge()
+
+					Ω(report.FailedToClaim).Should(Equal([]string{"some-guid"}))
+					Ω(report.KickedPending).Should(BeEmpty())
+
+					failed := storedTask("some-guid")
+					Ω(failed.State).Should(Equal(models.TaskStateCompleted))
+					Ω(failed.Failed).Should(BeTrue())
+					Ω(failed.FailureReason).Should(Equal(TaskUnclaimedReason))
+					Ω(failed.UpdatedAt).Should(Equal(timeProvider.Time().UnixNano()))
+				})
+			})
+		})
+
+		Context("when a task is claimed", func() {
+			BeforeEach(func() {
+				err := bbs.ClaimTask(task, "executor-id")
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			Context("and its executor is present", func() {
+				BeforeEach(func() {
+					presentExecutor("executor-id")
+				})
+
+				It("leaves it alone for under 30 seconds", func() {
+					timeProvider.IncrementBySeconds(29)
+
+					report := converge()
+
+					Ω(report.DemotedToPending).Should(BeEmpty())
+					Ω(storedTask("some-guid")).Should(Equal(*task))
+				})
+
+				It("demotes it to pending after 30 seconds", func() {
+					timeProvider.IncrementBySeconds(30)
+
+					report := converge()
+
+					Ω(report.DemotedToPending).Should(Equal([]string{"some-guid"}))
+
+					demoted := storedTask("some-guid")
+					Ω(demoted.State).Should(Equal(models.TaskStatePending))
+					Ω(demoted.ExecutorID).Should(BeEmpty())
+				})
+
+				Context("when it has been cancelled", func() {
+					BeforeEach(func() {
+						err := bbs.CancelTask(task.Guid)
+						Ω(err).ShouldNot(HaveOccurred())
+					})
+
+					It("fails it as cancelled", func() {
+						report := converge()
+
+						Ω(report.Cancelled).Should(Equal([]string{"some-guid"}))
+
+						failed := storedTask("some-guid")
+						Ω(failed.State).Should(Equal(models.TaskStateCompleted))
+						Ω(failed.FailureReason).Should(Equal(TaskCancelledReason))
+					})
+				})
+			})
+
+			Context("and its executor has disappeared", func() {
+				It("fails it", func() {
+					report := converge()
+
+					Ω(report.ExecutorDisappeared).Should(Equal([]string{"some-guid"}))
+
+					failed := storedTask("some-guid")
+					Ω(failed.State).Should(Equal(models.TaskStateCompleted))
+					Ω(failed.Failed).Should(BeTrue())
+					Ω(failed.FailureReason).Should(Equal(TaskExecutorDisappearedReason))
+				})
+			})
+		})
+
+		Context("when a task is running", func() {
+			BeforeEach(func() {
+				err := bbs.ClaimTask(task, "executor-id")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = bbs.StartTask(task, "container-handle")
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			Context("and its executor is present", func() {
+				It("leaves it alone, however long it runs", func() {
+					presentExecutor("executor-id")
+
+					timeProvider.IncrementBySeconds(3600)
+
+					converge()
+
+					Ω(storedTask("some-guid")).Should(Equal(*task))
+				})
+			})
+
+			Context("and its executor has disappeared", func() {
+				It("fails it", func() {
+					report := converge()
+
+					Ω(report.ExecutorDisappeared).Should(Equal([]string{"some-guid"}))
+					Ω(storedTask("some-guid").FailureReason).Should(Equal(TaskExecutorDisappearedReason))
+				})
+			})
+		})
+
+		Context("when a task is completed", func() {
+			BeforeEach(func() {
+				err := bbs.ClaimTask(task, "executor-id")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = bbs.CompleteTask(task, false, "", "a result")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				kicker.completed = nil
+			})
+
+			It("kicks its completion", func() {
+				report := converge()
+
+				Ω(report.KickedCompleted).Should(Equal([]string{"some-guid"}))
+				Ω(kicker.Completed()).Should(Equal([]string{"some-guid"}))
+			})
+
+			Context("and being resolved", func() {
+				BeforeEach(func() {
+					err := bbs.ResolvingTask(task)
+					Ω(err).ShouldNot(HaveOccurred())
+				})
+
+				It("leaves it alone for under 30 seconds", func() {
+					timeProvider.IncrementBySeconds(29)
+
+					report := converge()
+
+					Ω(report.DemotedToCompleted).Should(BeEmpty())
+					Ω(storedTask("some-guid").State).Should(Equal(models.TaskStateResolving))
+				})
+
+				It("demotes it to completed after 30 seconds", func() {
+					timeProvider.IncrementBySeconds(30)
+
+					report := converge()
+
+					Ω(report.DemotedToCompleted).Should(Equal([]string{"some-guid"}))
+					Ω(storedTask("some-guid").State).Should(Equal(models.TaskStateCompleted))
+				})
+			})
+		})
+
+		Context("when a task's JSON is malformed", func() {
+			BeforeEach(func() {
+				err := store.SetMulti([]storeadapter.StoreNode{
+					{Key: TaskSchemaPath("malformed"), Value: []byte("ß")},
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			It("deletes it, leaving the rest", func() {
+				report := converge()
+
+				Ω(report.Examined).Should(Equal(2))
+				Ω(report.DeletedMalformed).Should(Equal([]string{TaskSchemaPath("malformed")}))
+
+				_, err := store.Get(TaskSchemaPath("malformed"))
+				Ω(err).Should(Equal(storeadapter.ErrorKeyNotFound))
+
+				_, err = store.Get(TaskSchemaPath("some-guid"))
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+		})
+
+		Context("when a task changes before convergence can swap it", func() {
+			BeforeEach(func() {
+				timeProvider.IncrementBySeconds(60)
+
+				store.meddle = func() {
+					pending, err := bbs.GetAllPendingTasks()
+					Ω(err).ShouldNot(HaveOccurred())
+
+					err = bbs.ClaimTask(pending[0], "executor-id")
+					Ω(err).ShouldNot(HaveOccurred())
+				}
+			})
+
+			It("reports the failed swap and leaves the task as it was changed", func() {
+				report := converge()
+
+				Ω(report.FailedToClaim).Should(BeEmpty())
+				Ω(report.CompareAndSwapFailed).Should(Equal([]string{"some-guid"}))
+
+				Ω(storedTask("some-guid").State).Should(Equal(models.TaskStateClaimed))
+			})
+		})
+
+		Context("with many tasks, in small batches", func() {
+			BeforeEach(func() {
+				for _, guid := range []string{"guid-1", "guid-2", "guid-3", "guid-4"} {
+					err := bbs.DesireTask(&models.Task{
+						Guid: guid,
+						Actions: []models.ExecutorAction{
+							{Action: models.RunAction{Script: "true"}},
+						},
+					})
+					Ω(err).ShouldNot(HaveOccurred())
+				}
+
+				kicker.desired = nil
+			})
+
+			It("converges every one of them", func() {
+				report, err := bbs.ConvergeTasks(timeToClaim, ConvergenceOptions{
+					BatchSize: 2,
+					Workers:   2,
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(report.Examined).Should(Equal(5))
+				Ω(report.KickedPending).Should(HaveLen(5))
+				Ω(kicker.Desired()).Should(ConsistOf("some-guid", "guid-1", "guid-2", "guid-3", "guid-4"))
+			})
+
+			It("lists them a shard at a time, never all at once", func() {
+				converge()
+
+				Ω(store.listed).ShouldNot(ContainElement(TaskSchemaRoot))
+
+				shards := 0
+				for _, key := range store.listed {
+					if strings.HasPrefix(key, TaskSchemaRoot+"/") {
+						shards++
+					}
+				}
+
+				Ω(shards).Should(Equal(TaskShards))
+			})
+		})
+	})
+})
@@ -10,6 +10,8 @@ import (
 
 const FileServerSchemaRoot = SchemaRoot + "file_server"
 
+var ErrNoFileServerAvailable = errors.New("No file servers are currently available")
+
 type fileServerBBS struct {
 	store storeadapter.StoreAdapter
 }
@@ -27,12 +29,16 @@ func (self *fileServerBBS) MaintainFileServerPresence(heartbeatInterval time.Dur
 
 func (self *stagerBBS) GetAvailableFileServer() (string, error) {
 	node, err := self.store.ListRecursively(FileServerSchemaRoot)
+	if err == storeadapter.ErrorKeyNotFound {
+		return "", ErrNoFileServerAvailable
+	}
+
 	if err != nil {
 		return "", err
 	}
 
 	if len(node.ChildNodes) == 0 {
-		return "", errors.New("No file servers are currently available")
+		return "", ErrNoFileServerAvailable
 	}
 
 	randomServerIndex := rand.Intn(len(node.ChildNodes))
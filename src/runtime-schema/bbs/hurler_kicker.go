@@ -20,6 +20,17 @@ func NewHurlerKicker(address string) *HurlerKicker {
 	}
 }
 
+// ExecutorRouteHost is the hurler host through which executors supporting
+// the given stack are reached. Every executor is reachable through the
+// stackless "executor" host.
+func ExecutorRouteHost(stack string) string {
+	if stack == "" {
+		return "executor"
+	}
+
+	return "executor-" + stack
+}
+
 func (kicker *HurlerKicker) Desire(task *models.Task) {
 	log.Println("kicking desire")
 
@@ -34,7 +45,7 @@ func (kicker *HurlerKicker) Desire(task *models.Task) {
 			Path:   "/tasks",
 		},
 
-		Host: "executor",
+		Host: ExecutorRouteHost(task.Stack),
 
 		Body:          ioutil.NopCloser(bytes.NewBuffer(json)),
 		ContentLength: int64(len(json)),
@@ -0,0 +1,502 @@
+package inmemorystore
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/gunk/timeprovider"
+	"github.com/cloudfoundry/storeadapter"
+)
+
+// MaintainPollInterval is how often MaintainNode checks whether a node held by
+// someone else has gone away.
+var MaintainPollInterval = 10 * time.Millisecond
+
+// InMemoryStore is a StoreAdapter that keeps everything in memory, for
+// exercising the BBS without an etcd. TTLs are measured against the given
+// TimeProvider, so a fake one can be used to make nodes expire on demand.
+//
+// Directories are implicit: they exist for as long as they have children.
+type InMemoryStore struct {
+	timeProvider timeprovider.TimeProvider
+
+	nodes    map[string]*entry
+	watchers []*watcher
+	index    uint64
+
+	lock *sync.Mutex
+}
+
+type entry struct {
+	value     []byte
+	ttl       uint64
+	expiresAt time.Time
+	index     uint64
+
+	// closed when a maintained node is deleted or overwritten by someone
+	// other than its maintainer
+	lost chan struct{}
+}
+
+func New(timeProvider timeprovider.TimeProvider) *InMemoryStore {
+	return &InMemoryStore{
+		timeProvider: timeProvider,
+
+		nodes: map[string]*entry{},
+
+		lock: &sync.Mutex{},
+	}
+}
+
+func (store *InMemoryStore) Connect() error {
+	return nil
+}
+
+func (store *InMemoryStore) Disconnect() error {
+	return nil
+}
+
+func (store *InMemoryStore) Create(node storeadapter.StoreNode) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.expire()
+
+	key := normalize(node.Key)
+
+	if _, found := store.nodes[key]; found || store.isDir(key) {
+		return storeadapter.ErrorKeyExists
+	}
+
+	store.set(key, node)
+
+	return nil
+}
+
+func (store *InMemoryStore) Update(node storeadapter.StoreNode) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.expire()
+
+	key := normalize(node.Key)
+
+	if _, found := store.nodes[key]; !found {
+		return storeadapter.ErrorKeyNotFound
+	}
+
+	store.set(key, node)
+
+	return nil
+}
+
+func (store *InMemoryStore) SetMulti(nodes []storeadapter.StoreNode) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.expire()
+
+	for _, node := range nodes {
+		key := normalize(node.Key)
+
+		if store.isDir(key) {
+			return storeadapter.ErrorNodeIsDirectory
+		}
+
+		store.set(key, node)
+	}
+
+	return nil
+}
+
+func (store *InMemoryStore) CompareAndSwap(oldNode storeadapter.StoreNode, newNode storeadapter.StoreNode) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.expire()
+
+	key := normalize(oldNode.Key)
+
+	existing, found := store.nodes[key]
+	if !found {
+		return storeadapter.ErrorKeyNotFound
+	}
+
+	if string(existing.value) != string(oldNode.Value) {
+		return storeadapter.ErrorKeyComparisonFailed
+	}
+
+	store.set(normalize(newNode.Key), newNode)
+
+	return nil
+}
+
+// CompareAndDelete removes each node whose stored value still matches. Every
+// node is checked before any is removed, so either all go or none do.
+func (store *InMemoryStore) CompareAndDelete(nodes ...storeadapter.StoreNode) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.expire()
+
+	for _, node := range nodes {
+		existing, found := store.nodes[normalize(node.Key)]
+		if !found {
+			return storeadapter.ErrorKeyNotFound
+		}
+
+		if string(existing.value) != string(node.Value) {
+			return storeadapter.ErrorKeyComparisonFailed
+		}
+	}
+
+	for _, node := range nodes {
+		key := normalize(node.Key)
+
+		if _, found := store.nodes[key]; found {
+			store.remove(key, storeadapter.DeleteEvent)
+		}
+	}
+
+	return nil
+}
+
+func (store *InMemoryStore) Get(key string) (storeadapter.StoreNode, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.expire()
+
+	key = normalize(key)
+
+	existing, found := store.nodes[key]
+	if found {
+		return existing.storeNode(key), nil
+	}
+
+	if store.isDir(key) {
+		return storeadapter.StoreNode{}, storeadapter.ErrorNodeIsDirectory
+	}
+
+	return storeadapter.StoreNode{}, storeadapter.ErrorKeyNotFound
+}
+
+func (store *InMemoryStore) ListRecursively(key string) (storeadapter.StoreNode, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.expire()
+
+	key = normalize(key)
+
+	if _, found := store.nodes[key]; found {
+		return storeadapter.StoreNode{}, storeadapter.ErrorNodeIsNotDirectory
+	}
+
+	if key != "/" && !store.isDir(key) {
+		return storeadapter.StoreNode{}, storeadapter.ErrorKeyNotFound
+	}
+
+	return store.list(key), nil
+}
+
+// Delete removes each key, along with everything under it. Every key is
+// attempted; ErrorKeyNotFound is returned if any of them did not exist.
+func (store *InMemoryStore) Delete(keys ...string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.expire()
+
+	var err error
+
+	for _, key := range keys {
+		key = normalize(key)
+
+		deleted := false
+
+		for existingKey := range store.nodes {
+			if existingKey == key || isUnder(existingKey, key) {
+				store.remove(existingKey, storeadapter.DeleteEvent)
+				deleted = true
+			}
+		}
+
+		if !deleted {
+			err = storeadapter.ErrorKeyNotFound
+		}
+	}
+
+	return err
+}
+
+func (store *InMemoryStore) UpdateDirTTL(key string, ttl uint64) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.expire()
+
+	key = normalize(key)
+
+	if _, found := store.nodes[key]; found {
+		return storeadapter.ErrorNodeIsNotDirectory
+	}
+
+	if !store.isDir(key) {
+		return storeadapter.ErrorKeyNotFound
+	}
+
+	// directories are implicit here, so there is nothing to expire
+	return nil
+}
+
+// Watch sends events for every change under key until stop is closed.
+func (store *InMemoryStore) Watch(key string) (<-chan storeadapter.WatchEvent, chan<- bool, <-chan error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	watcher := newWatcher(normalize(key))
+
+	store.watchers = append(store.watchers, watcher)
+
+	go func() {
+		watcher.run()
+
+		store.lock.Lock()
+		defer store.lock.Unlock()
+
+		for i, w := range store.watchers {
+			if w == watcher {
+				store.watchers = append(store.watchers[:i], store.watchers[i+1:]...)
+				break
+			}
+		}
+	}()
+
+	return watcher.events, watcher.stop, watcher.errors
+}
+
+// MaintainNode waits for the node to be free (or already set to the same
+// value), sets it, and reports true on the returned channel. The node does
+// not expire while it is maintained; if anyone else deletes or overwrites
+// it, false is reported.
+//
+// To release the node, either close the release channel or send a channel
+// on it, which will be sent true once the node has been removed.
+func (store *InMemoryStore) MaintainNode(node storeadapter.StoreNode) (<-chan bool, chan chan bool, error) {
+	status := make(chan bool, 1)
+	release := make(chan chan bool)
+
+	key := normalize(node.Key)
+
+	go func() {
+		var lost chan struct{}
+
+		for lost == nil {
+			lost = store.acquire(key, node)
+			if lost != nil {
+				status <- true
+				break
+			}
+
+			select {
+			case <-time.After(MaintainPollInterval):
+			case released, ok := <-release:
+				close(status)
+
+				if ok {
+					released <- true
+				}
+
+				return
+			}
+		}
+
+		for {
+			select {
+			case <-lost:
+				lost = nil
+				status <- false
+
+			case released, ok := <-release:
+				if lost != nil {
+					store.Delete(key)
+				}
+
+				close(status)
+
+				if ok {
+					released <- true
+				}
+
+				return
+			}
+		}
+	}()
+
+	return status, release, nil
+}
+
+func (store *InMemoryStore) acquire(key string, node storeadapter.StoreNode) chan struct{} {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.expire()
+
+	existing, found := store.nodes[key]
+	if found && string(existing.value) != string(node.Value) {
+		return nil
+	}
+
+	node.TTL = 0
+	store.set(key, node)
+
+	lost := make(chan struct{})
+	store.nodes[key].lost = lost
+
+	return lost
+}
+
+// set must be called with the lock held.
+func (store *InMemoryStore) set(key string, node storeadapter.StoreNode) {
+	existing, found := store.nodes[key]
+
+	eventType := storeadapter.CreateEvent
+	if found {
+		eventType = storeadapter.UpdateEvent
+
+		if existing.lost != nil {
+			close(existing.lost)
+		}
+	}
+
+	store.index++
+
+	updated := &entry{
+		value: node.Value,
+		ttl:   node.TTL,
+		index: store.index,
+	}
+
+	if node.TTL > 0 {
+		updated.expiresAt = store.timeProvider.Time().Add(time.Duration(node.TTL) * time.Second)
+	}
+
+	store.nodes[key] = updated
+
+	store.notify(eventType, updated.storeNode(key))
+}
+
+// remove must be called with the lock held.
+func (store *InMemoryStore) remove(key string, eventType storeadapter.EventType) {
+	existing := store.nodes[key]
+
+	delete(store.nodes, key)
+
+	if existing.lost != nil {
+		close(existing.lost)
+	}
+
+	store.index++
+
+	store.notify(eventType, storeadapter.StoreNode{
+		Key:   key,
+		Index: store.index,
+	})
+}
+
+// expire removes any nodes whose TTL has run out. It must be called with the
+// lock held.
+func (store *InMemoryStore) expire() {
+	now := store.timeProvider.Time()
+
+	for key, existing := range store.nodes {
+		if existing.expiresAt.IsZero() || existing.expiresAt.After(now) {
+			continue
+		}
+
+		store.remove(key, storeadapter.ExpireEvent)
+	}
+}
+
+func (store *InMemoryStore) notify(eventType storeadapter.EventType, node storeadapter.StoreNode) {
+	for _, watcher := range store.watchers {
+		if node.Key == watcher.key || isUnder(node.Key, watcher.key) {
+			watcher.enqueue(storeadapter.WatchEvent{
+				Type: eventType,
+				Node: node,
+			})
+		}
+	}
+}
+
+func (store *InMemoryStore) isDir(key string) bool {
+	for existingKey := range store.nodes {
+		if isUnder(existingKey, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// list builds the directory tree under key. It must be called with the lock
+// held.
+func (store *InMemoryStore) list(key string) storeadapter.StoreNode {
+	dir := storeadapter.StoreNode{
+		Key: key,
+		Dir: true,
+	}
+
+	children := map[string]bool{}
+
+	for existingKey := range store.nodes {
+		if !isUnder(existingKey, key) {
+			continue
+		}
+
+		relative := strings.TrimPrefix(existingKey, strings.TrimSuffix(key, "/")+"/")
+		children[path.Join(key, strings.SplitN(relative, "/", 2)[0])] = true
+	}
+
+	childKeys := []string{}
+	for childKey := range children {
+		childKeys = append(childKeys, childKey)
+	}
+
+	sort.Strings(childKeys)
+
+	for _, childKey := range childKeys {
+		if existing, found := store.nodes[childKey]; found {
+			dir.ChildNodes = append(dir.ChildNodes, existing.storeNode(childKey))
+		} else {
+			dir.ChildNodes = append(dir.ChildNodes, store.list(childKey))
+		}
+	}
+
+	return dir
+}
+
+func (existing *entry) storeNode(key string) storeadapter.StoreNode {
+	return storeadapter.StoreNode{
+		Key:   key,
+		Value: existing.value,
+		TTL:   existing.ttl,
+		Index: existing.index,
+	}
+}
+
+func normalize(key string) string {
+	return path.Clean("/" + key)
+}
+
+func isUnder(key string, dir string) bool {
+	if dir == "/" {
+		return key != "/"
+	}
+
+	return strings.HasPrefix(key, dir+"/")
+}
@@ -0,0 +1,13 @@
+package inmemorystore_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestInmemorystore(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Inmemorystore Suite")
+}
@@ -0,0 +1,460 @@
+package inmemorystore_test
+
+import (
+	"time"
+
+	"github.com/cloudfoundry/gunk/timeprovider/faketimeprovider"
+	"github.com/cloudfoundry/storeadapter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "runtime-schema/bbs/inmemorystore"
+)
+
+var _ = Describe("InMemoryStore", func() {
+	var timeProvider *faketimeprovider.FakeTimeProvider
+	var store *InMemoryStore
+
+	node := func(key string, value string, ttl uint64) storeadapter.StoreNode {
+		return storeadapter.StoreNode{
+			Key:   key,
+			Value: []byte(value),
+			TTL:   ttl,
+		}
+	}
+
+	BeforeEach(func() {
+		timeProvider = &faketimeprovider.FakeTimeProvider{
+			TimeToProvide: time.Unix(1238, 0),
+		}
+
+		store = New(timeProvider)
+	})
+
+	Describe("Create", func() {
+		It("creates the node", func() {
+			err := store.Create(node("/a/b", "value", 0))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			stored, err := store.Get("/a/b")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(stored.Value)).Should(Equal("value"))
+		})
+
+		Context("when the key already exists", func() {
+			BeforeEach(func() {
+				err := store.Create(node("/a/b", "value", 0))
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			It("fails without touching it", func() {
+				err := store.Create(node("/a/b", "other", 0))
+				Ω(err).Should(Equal(storeadapter.ErrorKeyExists))
+
+				stored, err := store.Get("/a/b")
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(string(stored.Value)).Should(Equal("value"))
+			})
+
+			It("fails for the key's directory", func() {
+				err := store.Create(node("/a", "value", 0))
+				Ω(err).Should(Equal(storeadapter.ErrorKeyExists))
+			})
+		})
+	})
+
+	Describe("Update", func() {
+		It("fails when the key does not exist", func() {
+			err := store.Update(node("/a", "value", 0))
+			Ω(err).Should(Equal(storeadapter.ErrorKeyNotFound))
+		})
+
+		It("replaces an existing node", func() {
+			err := store.Create(node("/a", "value", 0))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = store.Update(node("/a", "other", 0))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			stored, err := store.Get("/a")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(stored.Value)).Should(Equal("other"))
+		})
+	})
+
+	Describe("SetMulti", func() {
+		It("sets every node, creating or replacing them", func() {
+			err := store.Create(node("/a", "value", 0))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = store.SetMulti([]storeadapter.StoreNode{
+				node("/a", "other", 0),
+				node("/b", "new", 0),
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			a, err := store.Get("/a")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(a.Value)).Should(Equal("other"))
+
+			b, err := store.Get("/b")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(b.Value)).Should(Equal("new"))
+		})
+
+		It("refuses to overwrite a directory", func() {
+			err := store.SetMulti([]storeadapter.StoreNode{node("/a/b", "value", 0)})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = store.SetMulti([]storeadapter.StoreNode{node("/a", "value", 0)})
+			Ω(err).Should(Equal(storeadapter.ErrorNodeIsDirectory))
+		})
+	})
+
+	Describe("Get", func() {
+		It("fails for missing keys", func() {
+			_, err := store.Get("/a")
+			Ω(err).Should(Equal(storeadapter.ErrorKeyNotFound))
+		})
+
+		It("fails for directories", func() {
+			err := store.Create(node("/a/b", "value", 0))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, err = store.Get("/a")
+			Ω(err).Should(Equal(storeadapter.ErrorNodeIsDirectory))
+		})
+	})
+
+	Describe("ListRecursively", func() {
+		BeforeEach(func() {
+			err := store.SetMulti([]storeadapter.StoreNode{
+				node("/a/b", "b", 0),
+				node("/a/c/d", "d", 0),
+				node("/e", "e", 0),
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("builds the tree under the key", func() {
+			list, err := store.ListRecursively("/a")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(list.Dir).Should(BeTrue())
+			Ω(list.ChildNodes).Should(HaveLen(2))
+
+			Ω(list.ChildNodes[0].Key).Should(Equal("/a/b"))
+			Ω(string(list.ChildNodes[0].Value)).Should(Equal("b"))
+
+			Ω(list.ChildNodes[1].Key).Should(Equal("/a/c"))
+			Ω(list.ChildNodes[1].Dir).Should(BeTrue())
+			Ω(list.ChildNodes[1].ChildNodes).Should(HaveLen(1))
+			Ω(string(list.ChildNodes[1].ChildNodes[0].Value)).Should(Equal("d"))
+		})
+
+		It("fails for leaves", func() {
+			_, err := store.ListRecursively("/e")
+			Ω(err).Should(Equal(storeadapter.ErrorNodeIsNotDirectory))
+		})
+
+		It("fails for missing keys", func() {
+			_, err := store.ListRecursively("/f")
+			Ω(err).Should(Equal(storeadapter.ErrorKeyNotFound))
+		})
+	})
+
+	Describe("Delete", func() {
+		It("removes the keys and everything under them", func() {
+			err := store.SetMulti([]storeadapter.StoreNode{
+				node("/a/b", "b", 0),
+				node("/a/c/d", "d", 0),
+				node("/e", "e", 0),
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = store.Delete("/a", "/e")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, err = store.ListRecursively("/a")
+			Ω(err).Should(Equal(storeadapter.ErrorKeyNotFound))
+
+			_, err = store.Get("/e")
+			Ω(err).Should(Equal(storeadapter.ErrorKeyNotFound))
+		})
+
+		It("deletes what it can but fails if any key is missing", func() {
+			err := store.Create(node("/a", "value", 0))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = store.Delete("/a", "/b")
+			Ω(err).Should(Equal(storeadapter.ErrorKeyNotFound))
+
+			_, err = store.Get("/a")
+			Ω(err).Should(Equal(storeadapter.ErrorKeyNotFound))
+		})
+	})
+
+	Describe("CompareAndSwap", func() {
+		BeforeEach(func() {
+			err := store.Create(node("/a", "old", 0))
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("swaps when the value matches", func() {
+			err := store.CompareAndSwap(node("/a", "old", 0), node("/a", "new", 0))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			stored, err := store.Get("/a")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(stored.Value)).Should(Equal("new"))
+		})
+
+		It("fails when the value has changed", func() {
+			err := store.CompareAndSwap(node("/a", "stale", 0), node("/a", "new", 0))
+			Ω(err).Should(Equal(storeadapter.ErrorKeyComparisonFailed))
+
+			stored, err := store.Get("/a")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(stored.Value)).Should(Equal("old"))
+		})
+
+		It("fails when the key does not exist", func() {
+			err := store.CompareAndSwap(node("/b", "old", 0), node("/b", "new", 0))
+			Ω(err).Should(Equal(storeadapter.ErrorKeyNotFound))
+		})
+	})
+
+	Describe("CompareAndDelete", func() {
+		BeforeEach(func() {
+			err := store.SetMulti([]storeadapter.StoreNode{
+				node("/a", "old", 0),
+				node("/b", "old", 0),
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("deletes when the values match", func() {
+			err := store.CompareAndDelete(node("/a", "old", 0), node("/b", "old", 0))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, err = store.Get("/a")
+			Ω(err).Should(Equal(storeadapter.ErrorKeyNotFound))
+
+			_, err = store.Get("/b")
+			Ω(err).Should(Equal(storeadapter.ErrorKeyNotFound))
+		})
+
+		It("deletes nothing when any value has changed", func() {
+			err := store.CompareAndDelete(node("/a", "old", 0), node("/b", "stale", 0))
+			Ω(err).Should(Equal(storeadapter.ErrorKeyComparisonFailed))
+
+			_, err = store.Get("/a")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, err = store.Get("/b")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("fails when the key does not exist", func() {
+			err := store.CompareAndDelete(node("/c", "old", 0))
+			Ω(err).Should(Equal(storeadapter.ErrorKeyNotFound))
+		})
+	})
+
+	Describe("TTLs", func() {
+		BeforeEach(func() {
+			err := store.Create(node("/a", "value", 10))
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("keeps the node until its TTL runs out", func() {
+			timeProvider.IncrementBySeconds(9)
+
+			stored, err := store.Get("/a")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(stored.TTL).Should(Equal(uint64(10)))
+
+			timeProvider.IncrementBySeconds(1)
+
+			_, err = store.Get("/a")
+			Ω(err).Should(Equal(storeadapter.ErrorKeyNotFound))
+		})
+
+		It("restarts the TTL when the node is set again", func() {
+			timeProvider.IncrementBySeconds(9)
+
+			err := store.Update(node("/a", "value", 10))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			timeProvider.IncrementBySeconds(9)
+
+			_, err = store.Get("/a")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("never expires nodes without a TTL", func() {
+			err := store.Create(node("/b", "value", 0))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			timeProvider.IncrementBySeconds(1000000)
+
+			_, err = store.Get("/b")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("lets an expired key be created again", func() {
+			timeProvider.IncrementBySeconds(10)
+
+			err := store.Create(node("/a", "other", 0))
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Describe("Watch", func() {
+		var events <-chan storeadapter.WatchEvent
+		var stop chan<- bool
+
+		BeforeEach(func() {
+			events, stop, _ = store.Watch("/a")
+		})
+
+		AfterEach(func() {
+			close(stop)
+		})
+
+		It("delivers changes under the key, in order", func() {
+			err := store.Create(node("/a/b", "value", 0))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = store.Update(node("/a/b", "other", 0))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = store.Delete("/a/b")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			var event storeadapter.WatchEvent
+
+			Eventually(events).Should(Receive(&event))
+			Ω(event.Type).Should(Equal(storeadapter.CreateEvent))
+			Ω(event.Node.Key).Should(Equal("/a/b"))
+			Ω(string(event.Node.Value)).Should(Equal("value"))
+
+			Eventually(events).Should(Receive(&event))
+			Ω(event.Type).Should(Equal(storeadapter.UpdateEvent))
+			Ω(string(event.Node.Value)).Should(Equal("other"))
+
+			Eventually(events).Should(Receive(&event))
+			Ω(event.Type).Should(Equal(storeadapter.DeleteEvent))
+			Ω(event.Node.Key).Should(Equal("/a/b"))
+		})
+
+		It("delivers expirations", func() {
+			err := store.Create(node("/a/b", "value", 10))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Eventually(events).Should(Receive())
+
+			timeProvider.IncrementBySeconds(10)
+
+			_, err = store.Get("/a/b")
+			Ω(err).Should(Equal(storeadapter.ErrorKeyNotFound))
+
+			var event storeadapter.WatchEvent
+
+			Eventually(events).Should(Receive(&event))
+			Ω(event.Type).Should(Equal(storeadapter.ExpireEvent))
+			Ω(event.Node.Key).Should(Equal("/a/b"))
+		})
+
+		It("ignores changes elsewhere", func() {
+			err := store.Create(node("/ab", "value", 0))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Consistently(events).ShouldNot(Receive())
+		})
+	})
+
+	Describe("MaintainNode", func() {
+		var status <-chan bool
+		var release chan chan bool
+
+		BeforeEach(func() {
+			var err error
+
+			status, release, err = store.MaintainNode(node("/lock", "me", 10))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Eventually(status).Should(Receive(BeTrue()))
+		})
+
+		It("sets the node, without letting it expire", func() {
+			timeProvider.IncrementBySeconds(1000)
+
+			stored, err := store.Get("/lock")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(stored.Value)).Should(Equal("me"))
+
+			close(release)
+		})
+
+		It("reports false when someone else deletes the node", func() {
+			err := store.Delete("/lock")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Eventually(status).Should(Receive(BeFalse()))
+
+			close(release)
+		})
+
+		It("reports false when someone else overwrites the node", func() {
+			err := store.Update(node("/lock", "someone else", 0))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Eventually(status).Should(Receive(BeFalse()))
+
+			close(release)
+
+			stored, err := store.Get("/lock")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(stored.Value)).Should(Equal("someone else"))
+		})
+
+		It("waits for a node held by someone else", func() {
+			otherStatus, otherRelease, err := store.MaintainNode(node("/lock", "other", 10))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Consistently(otherStatus).ShouldNot(Receive())
+
+			close(release)
+
+			Eventually(otherStatus).Should(Receive(BeTrue()))
+
+			close(otherRelease)
+		})
+
+		Context("when released with a channel", func() {
+			It("removes the node and then says so", func() {
+				released := make(chan bool)
+
+				release <- released
+
+				Eventually(released).Should(Receive(BeTrue()))
+				Eventually(status).Should(BeClosed())
+
+				_, err := store.Get("/lock")
+				Ω(err).Should(Equal(storeadapter.ErrorKeyNotFound))
+			})
+		})
+
+		Context("when released by closing", func() {
+			It("removes the node", func() {
+				close(release)
+
+				Eventually(status).Should(BeClosed())
+
+				_, err := store.Get("/lock")
+				Ω(err).Should(Equal(storeadapter.ErrorKeyNotFound))
+			})
+		})
+	})
+})
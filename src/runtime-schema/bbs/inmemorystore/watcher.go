@@ -0,0 +1,71 @@
+package inmemorystore
+
+import (
+	"sync"
+
+	"github.com/cloudfoundry/storeadapter"
+)
+
+// watcher queues up events so that the store never blocks on a slow reader.
+type watcher struct {
+	key string
+
+	events chan storeadapter.WatchEvent
+	stop   chan bool
+	errors chan error
+
+	queue     []storeadapter.WatchEvent
+	queueLock *sync.Mutex
+	wake      chan struct{}
+}
+
+func newWatcher(key string) *watcher {
+	return &watcher{
+		key: key,
+
+		events: make(chan storeadapter.WatchEvent),
+		stop:   make(chan bool),
+		errors: make(chan error),
+
+		queueLock: &sync.Mutex{},
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+func (w *watcher) enqueue(event storeadapter.WatchEvent) {
+	w.queueLock.Lock()
+	w.queue = append(w.queue, event)
+	w.queueLock.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers queued events until stop is closed.
+func (w *watcher) run() {
+	defer close(w.events)
+	defer close(w.errors)
+
+	for {
+		w.queueLock.Lock()
+		queue := w.queue
+		w.queue = nil
+		w.queueLock.Unlock()
+
+		for _, event := range queue {
+			select {
+			case w.events <- event:
+			case <-w.stop:
+				return
+			}
+		}
+
+		select {
+		case <-w.wake:
+		case <-w.stop:
+			return
+		}
+	}
+}
@@ -59,3 +59,95 @@ func (p *presence) Remove() {
 
 	<-stopFinishedChan
 }
+
+// heartbeatPresence re-sets its key on every heartbeat, so that its value can
+// change over time (unlike presence, whose value is fixed).
+type heartbeatPresence struct {
+	store   storeadapter.StoreAdapter
+	key     string
+	value   func() []byte
+	release chan chan bool
+}
+
+func NewHeartbeatPresence(store storeadapter.StoreAdapter, key string, value func() []byte) Presence {
+	return &heartbeatPresence{
+		store: store,
+		key:   key,
+		value: value,
+	}
+}
+
+func (p *heartbeatPresence) Maintain(interval time.Duration) (<-chan bool, error) {
+	if p.release != nil {
+		return nil, errors.New("Already maintaining a presence")
+	}
+
+	err := p.heartbeat(interval)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make(chan bool, 1)
+	status <- true
+
+	release := make(chan chan bool)
+	p.release = release
+
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := p.heartbeat(interval)
+				if err == nil {
+					continue
+				}
+
+				select {
+				case status <- false:
+				case stopFinished := <-release:
+					p.clear(status, stopFinished)
+					return
+				}
+
+			case stopFinished := <-release:
+				p.clear(status, stopFinished)
+				return
+			}
+		}
+	}()
+
+	return status, nil
+}
+
+func (p *heartbeatPresence) Remove() {
+	if p.release == nil {
+		return
+	}
+
+	release := p.release
+	p.release = nil
+
+	stopFinishedChan := make(chan bool)
+	release <- stopFinishedChan
+
+	<-stopFinishedChan
+}
+
+func (p *heartbeatPresence) heartbeat(interval time.Duration) error {
+	return p.store.SetMulti([]storeadapter.StoreNode{
+		{
+			Key:   p.key,
+			Value: p.value(),
+			TTL:   uint64(interval.Seconds()),
+		},
+	})
+}
+
+func (p *heartbeatPresence) clear(status chan bool, stopFinished chan bool) {
+	p.store.Delete(p.key)
+	close(status)
+	stopFinished <- true
+}
@@ -0,0 +1,77 @@
+package bbs
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/cloudfoundry/storeadapter"
+)
+
+// RetryPolicy bounds how long BBS operations keep retrying when the store
+// times out. Backoff doubles from InitialBackoff up to MaxBackoff, with
+// jitter, until either MaxAttempts or Deadline is reached.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Deadline       time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    10,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+	Deadline:       30 * time.Second,
+}
+
+// StoreTimeoutError is returned when the store kept timing out until the
+// retry policy gave up. The operation may or may not have taken effect.
+type StoreTimeoutError struct {
+	Attempts int
+	Elapsed  time.Duration
+}
+
+func (err StoreTimeoutError) Error() string {
+	return fmt.Sprintf("store timed out after %d attempts (%s)", err.Attempts, err.Elapsed)
+}
+
+func (policy RetryPolicy) retryOnStoreTimeout(callback func() error) error {
+	started := time.Now()
+	backoff := policy.InitialBackoff
+
+	for attempts := 1; ; attempts++ {
+		err := callback()
+		if err != storeadapter.ErrorTimeout {
+			return err
+		}
+
+		sleep := jitter(backoff)
+		elapsed := time.Since(started)
+
+		if attempts >= policy.MaxAttempts || elapsed+sleep > policy.Deadline {
+			return StoreTimeoutError{
+				Attempts: attempts,
+				Elapsed:  elapsed,
+			}
+		}
+
+		time.Sleep(sleep)
+
+		backoff *= 2
+		if backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+// jitter picks a duration between half of and all of the given one.
+func jitter(duration time.Duration) time.Duration {
+	if duration <= 1 {
+		return duration
+	}
+
+	half := duration / 2
+
+	return half + time.Duration(rand.Int63n(int64(duration-half)))
+}
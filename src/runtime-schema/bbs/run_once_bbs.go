@@ -1,8 +1,10 @@
 package bbs
 
 import (
+	"fmt"
 	steno "github.com/cloudfoundry/gosteno"
 	"github.com/cloudfoundry/storeadapter"
+	"hash/crc32"
 	"path"
 	"runtime-schema/models"
 	"time"
@@ -10,12 +12,24 @@ import (
 
 const ClaimTTL = 10 * time.Second
 const ResolvingTTL = 5 * time.Second
+const TaskCancelledReason = "cancelled"
+const TaskUnclaimedReason = "not claimed within time limit"
+const TaskExecutorDisappearedReason = "executor disappeared before completion"
 const TaskSchemaRoot = SchemaRoot + "run_once"
 const ExecutorSchemaRoot = SchemaRoot + "executor"
 const LockSchemaRoot = SchemaRoot + "locks"
 
-func taskSchemaPath(task *models.Task) string {
-	return path.Join(TaskSchemaRoot, task.Guid)
+// Run-onces are spread over TaskShards directories under TaskSchemaRoot, by a
+// hash of their guid, so that each directory can be listed on its own rather
+// than every run-once at once.
+const TaskShards = 64
+
+func TaskSchemaPath(guid string) string {
+	return path.Join(taskShardPath(int(crc32.ChecksumIEEE([]byte(guid))%TaskShards)), guid)
+}
+
+func taskShardPath(shard int) string {
+	return path.Join(TaskSchemaRoot, fmt.Sprintf("%02x", shard))
 }
 
 func executorSchemaPath(executorID string) string {
@@ -26,36 +40,132 @@ func lockSchemaPath(lockName string) string {
 	return path.Join(LockSchemaRoot, lockName)
 }
 
-func retryIndefinitelyOnStoreTimeout(callback func() error) error {
-	for {
-		err := callback()
+func watchForTaskModifications(store storeadapter.StoreAdapter, filter func(models.Task) bool) (<-chan *models.Task, chan<- bool, <-chan error) {
+	tasks := make(chan *models.Task)
+	stopOuter := make(chan bool)
+	errsOuter := make(chan error)
+
+	events, stopInner, errsInner := store.Watch(TaskSchemaRoot)
+
+	go func() {
+		defer close(tasks)
+		defer close(errsOuter)
+
+		for {
+			select {
+			case <-stopOuter:
+				close(stopInner)
+				return
+
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+
+				switch event.Type {
+				case storeadapter.CreateEvent, storeadapter.UpdateEvent:
+					task, err := models.NewTaskFromJSON(event.Node.Value)
+					if err != nil {
+						continue
+					}
+
+					if filter(task) {
+						tasks <- &task
+					}
+				}
 
-		if err == storeadapter.ErrorTimeout {
-			time.Sleep(time.Second)
-			continue
+			case err, ok := <-errsInner:
+				if ok {
+					errsOuter <- err
+				}
+				return
+			}
 		}
+	}()
 
+	return tasks, stopOuter, errsOuter
+}
+
+// compareAndSwapTask swaps in task if the task stored for it is still the
+// one encoded as originalValue. Callers encode the task as they last saw it,
+// which may not match the stored bytes even though the task is unchanged,
+// e.g. for tasks stored before states were named, or once a retried desire
+// has pointed the task at a new inbox; so if the plain swap fails and the
+// stored task encodes to originalValue but for its ReplyTo, task takes the
+// stored ReplyTo and the swap is retried against the stored bytes.
+func compareAndSwapTask(store storeadapter.StoreAdapter, originalValue []byte, task *models.Task) error {
+	key := TaskSchemaPath(task.Guid)
+
+	err := store.CompareAndSwap(storeadapter.StoreNode{
+		Key:   key,
+		Value: originalValue,
+	}, storeadapter.StoreNode{
+		Key:   key,
+		Value: task.ToJSON(),
+	})
+	if err != storeadapter.ErrorKeyComparisonFailed {
+		return err
+	}
+
+	node, getErr := store.Get(key)
+	if getErr != nil {
 		return err
 	}
+
+	stored, decodeErr := models.NewTaskFromJSON(node.Value)
+	if decodeErr != nil {
+		return err
+	}
+
+	original, decodeErr := models.NewTaskFromJSON(originalValue)
+	if decodeErr != nil {
+		return err
+	}
+
+	replyTo := stored.ReplyTo
+	stored.ReplyTo = original.ReplyTo
+	if string(stored.ToJSON()) != string(originalValue) {
+		return err
+	}
+
+	task.ReplyTo = replyTo
+
+	return store.CompareAndSwap(node, storeadapter.StoreNode{
+		Key:   key,
+		Value: task.ToJSON(),
+	})
 }
 
-func getAllTasks(store storeadapter.StoreAdapter, state models.TaskState) ([]*models.Task, error) {
-	node, err := store.ListRecursively(TaskSchemaRoot)
+// listTaskShard returns the nodes of the run-onces in one shard.
+func listTaskShard(store storeadapter.StoreAdapter, shard int) ([]storeadapter.StoreNode, error) {
+	node, err := store.ListRecursively(taskShardPath(shard))
 	if err == storeadapter.ErrorKeyNotFound {
-		return []*models.Task{}, nil
+		return []storeadapter.StoreNode{}, nil
 	}
 
 	if err != nil {
-		return []*models.Task{}, err
+		return []storeadapter.StoreNode{}, err
 	}
 
+	return node.ChildNodes, nil
+}
+
+func getAllTasks(store storeadapter.StoreAdapter, state models.TaskState) ([]*models.Task, error) {
 	tasks := []*models.Task{}
-	for _, node := range node.ChildNodes {
-		task, err := models.NewTaskFromJSON(node.Value)
+
+	for shard := 0; shard < TaskShards; shard++ {
+		nodes, err := listTaskShard(store, shard)
 		if err != nil {
-			steno.NewLogger("bbs").Errorf("cannot parse task JSON for key %s: %s", node.Key, err.Error())
-		} else if task.State == state {
-			tasks = append(tasks, &task)
+			return []*models.Task{}, err
+		}
+
+		for _, node := range nodes {
+			task, err := models.NewTaskFromJSON(node.Value)
+			if err != nil {
+				steno.NewLogger("bbs").Errorf("cannot parse task JSON for key %s: %s", node.Key, err.Error())
+			} else if task.State == state {
+				tasks = append(tasks, &task)
+			}
 		}
 	}
 
@@ -1,6 +1,8 @@
 package bbs
 
 import (
+	"errors"
+
 	"github.com/cloudfoundry/gunk/timeprovider"
 	"github.com/cloudfoundry/storeadapter"
 
@@ -10,28 +12,66 @@ import (
 type stagerBBS struct {
 	store        storeadapter.StoreAdapter
 	timeProvider timeprovider.TimeProvider
+	retryPolicy  RetryPolicy
+	knownStacks  []string
 
 	kicker Kicker
 }
 
+var ErrTaskAlreadyExists = errors.New("task already exists")
+var ErrTaskNotResolving = errors.New("task is not resolving")
+
 // The stager calls this when it wants to desire a payload
-// stagerBBS will retry this repeatedly if it gets a StoreTimeout error (up to N seconds?)
+// stagerBBS will retry this if it gets a StoreTimeout error, as its RetryPolicy allows
 // If this fails, the stager should bail and run its "this-failed-to-stage" routine
+// Invalid tasks are refused without touching the store, as are tasks whose guid is already desired (ErrTaskAlreadyExists)
 func (s *stagerBBS) DesireTask(task *models.Task) error {
-	return retryIndefinitelyOnStoreTimeout(func() error {
+	return s.desireTask(task, false)
+}
+
+// Like DesireTask, but succeeds without kicking if an identical task has already been desired,
+// replying to the new task's inbox from then on
+func (s *stagerBBS) DesireTaskIdempotently(task *models.Task) error {
+	return s.desireTask(task, true)
+}
+
+func (s *stagerBBS) desireTask(task *models.Task, idempotent bool) error {
+	err := task.Validate(s.knownStacks)
+	if err != nil {
+		return err
+	}
+
+	err = task.TransitionTo(models.TaskStatePending)
+	if err != nil {
+		return err
+	}
+
+	return s.retryPolicy.retryOnStoreTimeout(func() error {
 		if task.CreatedAt == 0 {
 			task.CreatedAt = s.timeProvider.Time().UnixNano()
 		}
 
 		task.UpdatedAt = s.timeProvider.Time().UnixNano()
-		task.State = models.TaskStatePending
 
-		err := s.store.SetMulti([]storeadapter.StoreNode{
-			{
-				Key:   taskSchemaPath(task),
-				Value: task.ToJSON(),
-			},
+		err := s.store.Create(storeadapter.StoreNode{
+			Key:   TaskSchemaPath(task.Guid),
+			Value: task.ToJSON(),
 		})
+		if err == storeadapter.ErrorKeyExists {
+			if idempotent {
+				desired, err := s.redesire(task)
+				if err != nil {
+					return err
+				}
+
+				if desired {
+					return nil
+				}
+			}
+
+			return ErrTaskAlreadyExists
+		}
+
 		if err != nil {
 			return err
 		}
@@ -42,28 +82,193 @@ func (s *stagerBBS) DesireTask(task *models.Task) error {
 	})
 }
 
+// redesire reports whether an identical task has already been desired. A
+// retried request comes with a fresh inbox, so the stored task is pointed at
+// it, for its completion to reach whoever is waiting now.
+func (s *stagerBBS) redesire(task *models.Task) (bool, error) {
+	key := TaskSchemaPath(task.Guid)
+
+	for {
+		node, err := s.store.Get(key)
+		if err == storeadapter.ErrorKeyNotFound {
+			return false, nil
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		existing, err := models.NewTaskFromJSON(node.Value)
+		if err != nil {
+			return false, nil
+		}
+
+		if string(desiredDefinition(existing).ToJSON()) != string(desiredDefinition(*task).ToJSON()) {
+			return false, nil
+		}
+
+		if existing.ReplyTo == task.ReplyTo {
+			return true, nil
+		}
+
+		// leave UpdatedAt alone, so whoever holds the task sees it differ
+		// only by its inbox
+		existing.ReplyTo = task.ReplyTo
+
+		err = s.store.CompareAndSwap(node, storeadapter.StoreNode{
+			Key:   key,
+			Value: existing.ToJSON(),
+		})
+		if err == storeadapter.ErrorKeyComparisonFailed {
+			continue
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		return true, nil
+	}
+}
+
+// desiredDefinition strips everything the lifecycle fills in, leaving only
+// what the stager asked for. Where to reply and where to upload to are left
+// out too: a retried request comes with a fresh inbox (see redesire), and may
+// be sent to a different file server.
+func desiredDefinition(task models.Task) models.Task {
+	task.ReplyTo = ""
+
+	actions := make([]models.ExecutorAction, len(task.Actions))
+	for i, action := range task.Actions {
+		if upload, ok := action.Action.(models.UploadAction); ok {
+			upload.To = ""
+			action.Action = upload
+		}
+
+		actions[i] = action
+	}
+
+	task.Actions = actions
+
+	task.State = models.TaskStateInvalid
+	task.CreatedAt = 0
+	task.UpdatedAt = 0
+	task.ExecutorID = ""
+	task.ContainerHandle = ""
+	task.Result = ""
+	task.Failed = false
+	task.FailureReason = ""
+	task.CancelRequested = false
+	return task
+}
+
 func (s *stagerBBS) ResolvingTask(task *models.Task) error {
 	originalValue := task.ToJSON()
 
+	err := task.TransitionTo(models.TaskStateResolving)
+	if err != nil {
+		return err
+	}
+
 	task.UpdatedAt = s.timeProvider.Time().UnixNano()
-	task.State = models.TaskStateResolving
-
-	return retryIndefinitelyOnStoreTimeout(func() error {
-		return s.store.CompareAndSwap(storeadapter.StoreNode{
-			Key:   taskSchemaPath(task),
-			Value: originalValue,
-		}, storeadapter.StoreNode{
-			Key:   taskSchemaPath(task),
-			Value: task.ToJSON(),
-		})
+
+	return s.retryPolicy.retryOnStoreTimeout(func() error {
+		return compareAndSwapTask(s.store, originalValue, task)
+	})
+}
+
+// The stager calls this when it no longer wants a runonce to run
+// Pending runonces are failed immediately; claimed or running runonces are flagged for their executor to abort
+// Runonces that have already completed are left alone
+func (s *stagerBBS) CancelTask(guid string) error {
+	key := TaskSchemaPath(guid)
+
+	return s.retryPolicy.retryOnStoreTimeout(func() error {
+		for {
+			node, err := s.store.Get(key)
+			if err != nil {
+				return err
+			}
+
+			task, err := models.NewTaskFromJSON(node.Value)
+			if err != nil {
+				return err
+			}
+
+			cancelled := task
+
+			switch task.State {
+			case models.TaskStatePending:
+				err = cancelled.TransitionTo(models.TaskStateCompleted)
+				if err != nil {
+					return err
+				}
+
+				cancelled = markTaskFailed(cancelled, TaskCancelledReason)
+				cancelled.UpdatedAt = s.timeProvider.Time().UnixNano()
+			case models.TaskStateClaimed, models.TaskStateRunning:
+				// leave UpdatedAt alone, so the executor's view of the task
+				// differs only by the flag
+				cancelled.CancelRequested = true
+			default:
+				return nil
+			}
+
+			err = s.store.CompareAndSwap(node, storeadapter.StoreNode{
+				Key:   key,
+				Value: cancelled.ToJSON(),
+			})
+			if err == storeadapter.ErrorKeyComparisonFailed {
+				continue
+			}
+
+			if err != nil {
+				return err
+			}
+
+			if cancelled.State == models.TaskStateCompleted {
+				s.kicker.Complete(&cancelled)
+			}
+
+			return nil
+		}
 	})
 }
 
 // The stager calls this when it wants to signal that it has received a completion and is handling it
-// stagerBBS will retry this repeatedly if it gets a StoreTimeout error (up to N seconds?)
+// stagerBBS will retry this if it gets a StoreTimeout error, as its RetryPolicy allows
 // If this fails, the stager should assume that someone else is handling the completion and should bail
+// Only a runonce that is resolving, both as the stager sees it and as stored, is removed (else ErrTaskNotResolving)
 func (s *stagerBBS) ResolveTask(task *models.Task) error {
-	return retryIndefinitelyOnStoreTimeout(func() error {
-		return s.store.Delete(taskSchemaPath(task))
+	if task.State != models.TaskStateResolving {
+		return ErrTaskNotResolving
+	}
+
+	key := TaskSchemaPath(task.Guid)
+
+	return s.retryPolicy.retryOnStoreTimeout(func() error {
+		for {
+			node, err := s.store.Get(key)
+			if err != nil {
+				return err
+			}
+
+			stored, err := models.NewTaskFromJSON(node.Value)
+			if err != nil {
+				return err
+			}
+
+			if stored.State != models.TaskStateResolving {
+				return ErrTaskNotResolving
+			}
+
+			// only remove it as read, in case convergence demotes it meanwhile
+			err = s.store.CompareAndDelete(node)
+			if err == storeadapter.ErrorKeyComparisonFailed {
+				continue
+			}
+
+			return err
+		}
 	})
 }
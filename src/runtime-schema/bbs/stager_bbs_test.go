@@ -0,0 +1,413 @@
+package bbs_test
+
+import (
+	"time"
+
+	"github.com/cloudfoundry/gunk/timeprovider/faketimeprovider"
+	"github.com/cloudfoundry/storeadapter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "runtime-schema/bbs"
+	"runtime-schema/bbs/inmemorystore"
+	"runtime-schema/models"
+)
+
+var _ = Describe("Stager BBS", func() {
+	var timeProvider *faketimeprovider.FakeTimeProvider
+	var store *meddlingStore
+	var kicker *fakeKicker
+	var bbs *BBS
+	var task *models.Task
+
+	BeforeEach(func() {
+		timeProvider = &faketimeprovider.FakeTimeProvider{
+			TimeToProvide: time.Unix(1238, 0),
+		}
+
+		store = &meddlingStore{InMemoryStore: inmemorystore.New(timeProvider)}
+		kicker = &fakeKicker{}
+		bbs = New(kicker, store, timeProvider)
+
+		task = &models.Task{
+			Guid: "some-guid",
+			Actions: []models.ExecutorAction{
+				{Action: models.RunAction{Script: "true"}},
+			},
+			ReplyTo: "some-inbox",
+		}
+	})
+
+	Describe("DesireTask", func() {
+		It("creates the task as pending and kicks it", func() {
+			err := bbs.DesireTask(task)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(task.State).Should(Equal(models.TaskStatePending))
+			Ω(task.CreatedAt).Should(Equal(timeProvider.Time().UnixNano()))
+			Ω(task.UpdatedAt).Should(Equal(timeProvider.Time().UnixNano()))
+
+			tasks, err := bbs.GetAllPendingTasks()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(tasks).Should(HaveLen(1))
+			Ω(tasks[0]).Should(Equal(task))
+
+			Ω(kicker.Desired()).Should(Equal([]string{"some-guid"}))
+		})
+
+		Context("when the task is invalid", func() {
+			BeforeEach(func() {
+				task.Actions = nil
+			})
+
+			It("refuses it without touching the store", func() {
+				err := bbs.DesireTask(task)
+				Ω(err).Should(HaveOccurred())
+
+				_, err = store.ListRecursively(TaskSchemaRoot)
+				Ω(err).Should(Equal(storeadapter.ErrorKeyNotFound))
+
+				Ω(kicker.Desired()).Should(BeEmpty())
+			})
+		})
+
+		Context("when the task asks for a stack", func() {
+			BeforeEach(func() {
+				task.Stack = "some-stack"
+			})
+
+			It("accepts any stack by default", func() {
+				err := bbs.DesireTask(task)
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			Context("and the BBS is configured with known stacks", func() {
+				BeforeEach(func() {
+					config := DefaultConfig
+					config.KnownStacks = []string{"other-stack"}
+
+					bbs = NewWithConfig(kicker, store, timeProvider, config)
+				})
+
+				It("refuses unknown stacks", func() {
+					err := bbs.DesireTask(task)
+					Ω(err).Should(MatchError(`invalid task: unknown stack "some-stack"`))
+				})
+
+				It("accepts known stacks", func() {
+					task.Stack = "other-stack"
+
+					err := bbs.DesireTask(task)
+					Ω(err).ShouldNot(HaveOccurred())
+				})
+			})
+		})
+
+		Context("when a task with the same guid is already desired", func() {
+			BeforeEach(func() {
+				duplicate := *task
+
+				err := bbs.DesireTask(&duplicate)
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			It("fails without kicking again", func() {
+				err := bbs.DesireTask(task)
+				Ω(err).Should(Equal(ErrTaskAlreadyExists))
+
+				Ω(kicker.Desired()).Should(HaveLen(1))
+			})
+		})
+	})
+
+	Describe("DesireTaskIdempotently", func() {
+		BeforeEach(func() {
+			original := *task
+
+			err := bbs.DesireTaskIdempotently(&original)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		Context("when the same task is desired again", func() {
+			It("succeeds without kicking again", func() {
+				timeProvider.IncrementBySeconds(5)
+
+				err := bbs.DesireTaskIdempotently(task)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(kicker.Desired()).Should(HaveLen(1))
+			})
+
+			It("succeeds once the task has moved on", func() {
+				pending, err := bbs.GetAllPendingTasks()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = bbs.ClaimTask(pending[0], "executor-id")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = bbs.DesireTaskIdempotently(task)
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+		})
+
+		Context("when it is desired again with a new inbox and upload URL", func() {
+			It("succeeds without kicking again, replying to the new inbox", func() {
+				task.Actions = append(task.Actions, models.ExecutorAction{
+					Action: models.UploadAction{From: "/droplet.tgz", To: "http://file-server-1/droplet"},
+				})
+
+				original := *task
+				original.Guid = "upload-guid"
+
+				err := bbs.DesireTaskIdempotently(&original)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				retry := *task
+				retry.Guid = "upload-guid"
+				retry.ReplyTo = "another-inbox"
+				retry.Actions = []models.ExecutorAction{
+					task.Actions[0],
+					{Action: models.UploadAction{From: "/droplet.tgz", To: "http://file-server-2/droplet"}},
+				}
+
+				err = bbs.DesireTaskIdempotently(&retry)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(kicker.Desired()).Should(Equal([]string{"some-guid", "upload-guid"}))
+
+				node, err := store.Get(TaskSchemaPath("upload-guid"))
+				Ω(err).ShouldNot(HaveOccurred())
+
+				desired, err := models.NewTaskFromJSON(node.Value)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(desired.ReplyTo).Should(Equal("another-inbox"))
+				Ω(desired.UpdatedAt).Should(Equal(original.UpdatedAt))
+			})
+		})
+
+		Context("when a different task with the same guid is desired", func() {
+			It("fails", func() {
+				task.MemoryMB = 1024
+
+				err := bbs.DesireTaskIdempotently(task)
+				Ω(err).Should(Equal(ErrTaskAlreadyExists))
+			})
+		})
+	})
+
+	Context("when the task has completed", func() {
+		BeforeEach(func() {
+			err := bbs.DesireTask(task)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = bbs.ClaimTask(task, "executor-id")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = bbs.StartTask(task, "container-handle")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = bbs.CompleteTask(task, false, "", "a result")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		Describe("ResolvingTask", func() {
+			It("marks the task as resolving", func() {
+				err := bbs.ResolvingTask(task)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				tasks, err := bbs.GetAllResolvingTasks()
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(tasks).Should(HaveLen(1))
+				Ω(tasks[0].Result).Should(Equal("a result"))
+			})
+
+			Context("when another stager got there first", func() {
+				It("fails", func() {
+					otherStagersCopy := *task
+
+					err := bbs.ResolvingTask(&otherStagersCopy)
+					Ω(err).ShouldNot(HaveOccurred())
+
+					err = bbs.ResolvingTask(task)
+					Ω(err).Should(Equal(storeadapter.ErrorKeyComparisonFailed))
+				})
+			})
+
+			Context("when the task is already resolving", func() {
+				It("refuses the transition", func() {
+					err := bbs.ResolvingTask(task)
+					Ω(err).ShouldNot(HaveOccurred())
+
+					err = bbs.ResolvingTask(task)
+					Ω(err).Should(BeAssignableToTypeOf(models.IllegalTransitionError{}))
+				})
+			})
+		})
+
+		Describe("ResolveTask", func() {
+			It("removes the task", func() {
+				err := bbs.ResolvingTask(task)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = bbs.ResolveTask(task)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				_, err = store.Get(TaskSchemaPath("some-guid"))
+				Ω(err).Should(Equal(storeadapter.ErrorKeyNotFound))
+			})
+
+			Context("when the task is not resolving", func() {
+				It("refuses to remove it", func() {
+					err := bbs.ResolveTask(task)
+					Ω(err).Should(Equal(ErrTaskNotResolving))
+
+					_, err = store.Get(TaskSchemaPath("some-guid"))
+					Ω(err).ShouldNot(HaveOccurred())
+				})
+			})
+
+			Context("when convergence has demoted the task back to completed", func() {
+				It("refuses to remove it", func() {
+					err := bbs.ResolvingTask(task)
+					Ω(err).ShouldNot(HaveOccurred())
+
+					timeProvider.IncrementBySeconds(30)
+
+					_, err = bbs.ConvergeTasks(time.Hour, DefaultConvergenceOptions)
+					Ω(err).ShouldNot(HaveOccurred())
+
+					err = bbs.ResolveTask(task)
+					Ω(err).Should(Equal(ErrTaskNotResolving))
+
+					_, err = store.Get(TaskSchemaPath("some-guid"))
+					Ω(err).ShouldNot(HaveOccurred())
+				})
+			})
+
+			Context("when the task is demoted between being read and removed", func() {
+				It("refuses to remove it", func() {
+					err := bbs.ResolvingTask(task)
+					Ω(err).ShouldNot(HaveOccurred())
+
+					store.meddle = func() {
+						demoted := *task
+						demoted.State = models.TaskStateCompleted
+
+						err := store.Update(storeadapter.StoreNode{
+							Key:   TaskSchemaPath("some-guid"),
+							Value: demoted.ToJSON(),
+						})
+						Ω(err).ShouldNot(HaveOccurred())
+					}
+
+					err = bbs.ResolveTask(task)
+					Ω(err).Should(Equal(ErrTaskNotResolving))
+
+					stored, err := store.Get(TaskSchemaPath("some-guid"))
+					Ω(err).ShouldNot(HaveOccurred())
+
+					demoted, err := models.NewTaskFromJSON(stored.Value)
+					Ω(err).ShouldNot(HaveOccurred())
+					Ω(demoted.State).Should(Equal(models.TaskStateCompleted))
+				})
+			})
+		})
+	})
+
+	Describe("CancelTask", func() {
+		Context("when the task is pending", func() {
+			BeforeEach(func() {
+				err := bbs.DesireTask(task)
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			It("fails the task and kicks its completion", func() {
+				err := bbs.CancelTask(task.Guid)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				tasks, err := bbs.GetAllCompletedTasks()
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(tasks).Should(HaveLen(1))
+				Ω(tasks[0].Failed).Should(BeTrue())
+				Ω(tasks[0].FailureReason).Should(Equal(TaskCancelledReason))
+
+				Ω(kicker.Completed()).Should(Equal([]string{"some-guid"}))
+			})
+		})
+
+		Context("when the task is claimed", func() {
+			BeforeEach(func() {
+				err := bbs.DesireTask(task)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = bbs.ClaimTask(task, "executor-id")
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			It("flags it for its executor, changing nothing else", func() {
+				err := bbs.CancelTask(task.Guid)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				tasks, err := bbs.GetAllClaimedTasks()
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(tasks).Should(HaveLen(1))
+				Ω(tasks[0].CancelRequested).Should(BeTrue())
+
+				flagged := *task
+				flagged.CancelRequested = true
+				Ω(tasks[0]).Should(Equal(&flagged))
+
+				Ω(kicker.Completed()).Should(BeEmpty())
+			})
+		})
+
+		Context("when the task has completed", func() {
+			BeforeEach(func() {
+				err := bbs.DesireTask(task)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = bbs.CancelTask(task.Guid)
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			It("leaves it alone", func() {
+				before, err := store.Get(TaskSchemaPath("some-guid"))
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = bbs.CancelTask(task.Guid)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				after, err := store.Get(TaskSchemaPath("some-guid"))
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(after.Value).Should(Equal(before.Value))
+
+				Ω(kicker.Completed()).Should(HaveLen(1))
+			})
+		})
+
+		Context("when the task does not exist", func() {
+			It("fails", func() {
+				err := bbs.CancelTask("no-such-guid")
+				Ω(err).Should(Equal(storeadapter.ErrorKeyNotFound))
+			})
+		})
+	})
+
+	Describe("GetAvailableFileServer", func() {
+		It("fails when there are no file servers", func() {
+			_, err := bbs.GetAvailableFileServer()
+			Ω(err).Should(Equal(ErrNoFileServerAvailable))
+		})
+
+		It("returns the URL of a present file server", func() {
+			err := store.SetMulti([]storeadapter.StoreNode{
+				{Key: FileServerSchemaRoot + "/file-server-id", Value: []byte("http://file-server.example.com")},
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			url, err := bbs.GetAvailableFileServer()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(url).Should(Equal("http://file-server.example.com"))
+		})
+	})
+})
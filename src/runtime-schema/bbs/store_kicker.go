@@ -0,0 +1,36 @@
+package bbs
+
+import (
+	"github.com/cloudfoundry/storeadapter"
+
+	"runtime-schema/models"
+)
+
+// StoreKicker kicks desired run-onces by re-setting them in the store, which
+// wakes up any executors watching for them. Completions are handed to the
+// wrapped Kicker.
+type StoreKicker struct {
+	store     storeadapter.StoreAdapter
+	completer Kicker
+}
+
+func NewStoreKicker(store storeadapter.StoreAdapter, completer Kicker) *StoreKicker {
+	return &StoreKicker{
+		store:     store,
+		completer: completer,
+	}
+}
+
+func (kicker *StoreKicker) Desire(task *models.Task) {
+	node := storeadapter.StoreNode{
+		Key:   TaskSchemaPath(task.Guid),
+		Value: task.ToJSON(),
+	}
+
+	// if this fails, the run-once has moved on and there's nothing to kick
+	kicker.store.CompareAndSwap(node, node)
+}
+
+func (kicker *StoreKicker) Complete(task *models.Task) {
+	kicker.completer.Complete(task)
+}
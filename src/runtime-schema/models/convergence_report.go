@@ -0,0 +1,71 @@
+package models
+
+// ConvergenceReport records what a single convergence run did, by the guid
+// of every run-once it acted on.
+type ConvergenceReport struct {
+	StartedAt int64 `json:"started_at"`
+	Duration  int64 `json:"duration"` // nanoseconds
+
+	Examined int `json:"examined"`
+
+	KickedPending   []string `json:"kicked_pending"`
+	KickedCompleted []string `json:"kicked_completed"`
+
+	DemotedToPending   []string `json:"demoted_to_pending"`
+	DemotedToCompleted []string `json:"demoted_to_completed"`
+
+	FailedToClaim       []string `json:"failed_to_claim"`
+	ExecutorDisappeared []string `json:"executor_disappeared"`
+	Cancelled           []string `json:"cancelled"`
+
+	CompareAndSwapFailed []string `json:"compare_and_swap_failed"`
+
+	// run-onces convergence wanted to move in a way the state machine
+	// forbids; they are left untouched
+	IllegalTransitions []string `json:"illegal_transitions"`
+
+	// keys rather than guids, as their contents couldn't be parsed
+	DeletedMalformed []string `json:"deleted_malformed"`
+}
+
+func (self ConvergenceReport) Counts() map[string]int {
+	return map[string]int{
+		"examined":                self.Examined,
+		"kicked_pending":          len(self.KickedPending),
+		"kicked_completed":        len(self.KickedCompleted),
+		"demoted_to_pending":      len(self.DemotedToPending),
+		"demoted_to_completed":    len(self.DemotedToCompleted),
+		"failed_to_claim":         len(self.FailedToClaim),
+		"executor_disappeared":    len(self.ExecutorDisappeared),
+		"cancelled":               len(self.Cancelled),
+		"compare_and_swap_failed": len(self.CompareAndSwapFailed),
+		"illegal_transitions":     len(self.IllegalTransitions),
+		"deleted_malformed":       len(self.DeletedMalformed),
+	}
+}
+
+// Sample returns a copy of the report listing no more than limit guids (or
+// keys) of each kind, for when the whole report would be too large to send.
+// Counts() of the full report says how many there were.
+func (self ConvergenceReport) Sample(limit int) ConvergenceReport {
+	sample := func(guids []string) []string {
+		if len(guids) > limit {
+			return guids[:limit]
+		}
+
+		return guids
+	}
+
+	self.KickedPending = sample(self.KickedPending)
+	self.KickedCompleted = sample(self.KickedCompleted)
+	self.DemotedToPending = sample(self.DemotedToPending)
+	self.DemotedToCompleted = sample(self.DemotedToCompleted)
+	self.FailedToClaim = sample(self.FailedToClaim)
+	self.ExecutorDisappeared = sample(self.ExecutorDisappeared)
+	self.Cancelled = sample(self.Cancelled)
+	self.CompareAndSwapFailed = sample(self.CompareAndSwapFailed)
+	self.IllegalTransitions = sample(self.IllegalTransitions)
+	self.DeletedMalformed = sample(self.DeletedMalformed)
+
+	return self
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"encoding/json"
+)
+
+type ExecutorResources struct {
+	MemoryMB        int `json:"memory_mb"`
+	DiskMB          int `json:"disk_mb"`
+	FileDescriptors int `json:"file_descriptors"`
+}
+
+type ExecutorCapacity struct {
+	Total     ExecutorResources `json:"total"`
+	Remaining ExecutorResources `json:"remaining"`
+}
+
+// ExecutorPresence is what an executor advertises about itself while it is
+// present, refreshed on every heartbeat.
+type ExecutorPresence struct {
+	ExecutorID string            `json:"executor_id"`
+	Address    string            `json:"address"`
+	Stacks     []string          `json:"stacks"`
+	Total      ExecutorResources `json:"total"`
+	Available  ExecutorResources `json:"available"`
+	Version    string            `json:"version"`
+}
+
+func NewExecutorPresenceFromJSON(payload []byte) (ExecutorPresence, error) {
+	var presence ExecutorPresence
+
+	err := json.Unmarshal(payload, &presence)
+	if err != nil {
+		return ExecutorPresence{}, err
+	}
+
+	return presence, nil
+}
+
+func (self ExecutorPresence) ToJSON() []byte {
+	bytes, err := json.Marshal(self)
+	if err != nil {
+		panic(err)
+	}
+
+	return bytes
+}
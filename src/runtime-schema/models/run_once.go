@@ -2,6 +2,8 @@ package models
 
 import (
 	"encoding/json"
+	"fmt"
+	"strings"
 )
 
 type TaskState int
@@ -15,14 +17,20 @@ const (
 	TaskStateResolving
 )
 
+// TaskTypeStaging marks tasks that stage an app for the CC, whose completion
+// is reported back as a StagingResponseForCC.
+const TaskTypeStaging = "staging"
+
 type Task struct {
 	Guid            string           `json:"guid"`
+	Type            string           `json:"type,omitempty"`
 	Actions         []ExecutorAction `json:"actions"`
 	Stack           string           `json:"stack"`
 	FileDescriptors int              `json:"file_descriptors"`
 	MemoryMB        int              `json:"memory_mb"`
 	DiskMB          int              `json:"disk_mb"`
 	Log             LogConfig        `json:"log"`
+	PhaseDurations  *PhaseDurations  `json:"phase_durations,omitempty"`
 	CreatedAt       int64            `json:"created_at"` //  the number of nanoseconds elapsed since January 1, 1970 UTC
 	UpdatedAt       int64            `json:"updated_at"`
 
@@ -41,6 +49,9 @@ type Task struct {
 	Result        string `json:"result"`
 	Failed        bool   `json:"failed"`
 	FailureReason string `json:"failure_reason"`
+
+	// set by the stager to ask the owning executor to abort the task
+	CancelRequested bool `json:"cancel_requested,omitempty"`
 }
 
 type LogConfig struct {
@@ -49,6 +60,15 @@ type LogConfig struct {
 	Index      *int   `json:"index"`
 }
 
+// PhaseDurations overrides how long a simulating executor spends in each
+// phase of running the task. Each value is a distribution spec, e.g.
+// "uniform:500ms,1s" or "normal:5s,500ms".
+type PhaseDurations struct {
+	Hesitate        string `json:"hesitate,omitempty"`
+	CreateContainer string `json:"create_container,omitempty"`
+	Run             string `json:"run,omitempty"`
+}
+
 func NewTaskFromJSON(payload []byte) (Task, error) {
 	var task Task
 
@@ -60,6 +80,61 @@ func NewTaskFromJSON(payload []byte) (Task, error) {
 	return task, nil
 }
 
+// Validate checks that the task could be run. A task may ask for any of
+// knownStacks, or for any stack at all if knownStacks is nil; a task with no
+// stack can run on any executor.
+func (self Task) Validate(knownStacks []string) error {
+	var problems []string
+
+	if self.Guid == "" {
+		problems = append(problems, "guid is empty")
+	}
+
+	if len(self.Actions) == 0 {
+		problems = append(problems, "no actions")
+	}
+
+	for i, action := range self.Actions {
+		switch action.Action.(type) {
+		case DownloadAction, RunAction, UploadAction, FetchResultAction:
+		default:
+			problems = append(problems, fmt.Sprintf("action %d is unknown", i))
+		}
+	}
+
+	if self.Stack != "" && knownStacks != nil && !isKnownStack(self.Stack, knownStacks) {
+		problems = append(problems, fmt.Sprintf("unknown stack %q", self.Stack))
+	}
+
+	if self.MemoryMB < 0 {
+		problems = append(problems, "memory_mb is negative")
+	}
+
+	if self.DiskMB < 0 {
+		problems = append(problems, "disk_mb is negative")
+	}
+
+	if self.FileDescriptors < 0 {
+		problems = append(problems, "file_descriptors is negative")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid task: %s", strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+func isKnownStack(stack string, knownStacks []string) bool {
+	for _, known := range knownStacks {
+		if stack == known {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (self Task) ToJSON() []byte {
 	bytes, err := json.Marshal(self)
 	if err != nil {
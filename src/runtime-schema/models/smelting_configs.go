@@ -31,12 +31,13 @@ const (
 	LinuxSmeltingBuildpackOrderFlag = "buildpackOrder"
 )
 
+// Paths are relative, as the smelter runs from the task's scratch directory.
 var LinuxSmeltingDefaults = map[string]string{
-	LinuxSmeltingAppDirFlag:        "/app",
-	LinuxSmeltingOutputDirFlag:     "/tmp/droplet",
-	LinuxSmeltingResultDirFlag:     "/tmp/result",
-	LinuxSmeltingBuildpacksDirFlag: "/tmp/buildpacks",
-	LinuxSmeltingCacheDirFlag:      "/tmp/cache",
+	LinuxSmeltingAppDirFlag:        "app",
+	LinuxSmeltingOutputDirFlag:     "tmp/droplet",
+	LinuxSmeltingResultDirFlag:     "tmp/result",
+	LinuxSmeltingBuildpacksDirFlag: "tmp/buildpacks",
+	LinuxSmeltingCacheDirFlag:      "tmp/cache",
 }
 
 func NewLinuxSmeltingConfig(buildpacks []string) LinuxSmeltingConfig {
@@ -78,7 +79,7 @@ func NewLinuxSmeltingConfig(buildpacks []string) LinuxSmeltingConfig {
 		"comma-separated list of buildpacks, to be tried in order",
 	)
 
-	compilerPath := "/tmp/compiler"
+	compilerPath := "tmp/compiler"
 
 	return LinuxSmeltingConfig{
 		FlagSet: flagSet,
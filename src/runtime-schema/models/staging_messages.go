@@ -12,6 +12,11 @@ type StagingRequestFromCC struct {
 	Environment        [][]string  `json:"environment"`
 }
 
+type StopStagingRequestFromCC struct {
+	AppId  string `json:"app_id"`
+	TaskId string `json:"task_id"`
+}
+
 type Buildpack struct {
 	Key string `json:"key"`
 	Url string `json:"url"`
@@ -0,0 +1,118 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var InvalidTaskState = errors.New("Invalid Task State")
+
+var taskStateNames = map[TaskState]string{
+	TaskStateInvalid:   "invalid",
+	TaskStatePending:   "pending",
+	TaskStateClaimed:   "claimed",
+	TaskStateRunning:   "running",
+	TaskStateCompleted: "completed",
+	TaskStateResolving: "resolving",
+}
+
+func (state TaskState) String() string {
+	name, found := taskStateNames[state]
+	if !found {
+		return fmt.Sprintf("TaskState(%d)", int(state))
+	}
+
+	return name
+}
+
+func (state TaskState) MarshalJSON() ([]byte, error) {
+	name, found := taskStateNames[state]
+	if !found {
+		return nil, InvalidTaskState
+	}
+
+	return json.Marshal(name)
+}
+
+// UnmarshalJSON accepts either the state's name or, for tasks stored before
+// states were named, its number.
+func (state *TaskState) UnmarshalJSON(payload []byte) error {
+	var name string
+
+	err := json.Unmarshal(payload, &name)
+	if err != nil {
+		var number int
+
+		err = json.Unmarshal(payload, &number)
+		if err != nil {
+			return err
+		}
+
+		if _, found := taskStateNames[TaskState(number)]; !found {
+			return InvalidTaskState
+		}
+
+		*state = TaskState(number)
+
+		return nil
+	}
+
+	for candidate, candidateName := range taskStateNames {
+		if candidateName == name {
+			*state = candidate
+			return nil
+		}
+	}
+
+	return InvalidTaskState
+}
+
+// legalTransitions lists the states a task may move to from each state.
+var legalTransitions = map[TaskState][]TaskState{
+	TaskStateInvalid: {TaskStatePending},
+
+	// claimed by an executor, or failed by convergence/cancellation
+	TaskStatePending: {TaskStateClaimed, TaskStateCompleted},
+
+	// started, demoted back to pending, or failed before starting
+	TaskStateClaimed: {TaskStateRunning, TaskStatePending, TaskStateCompleted},
+
+	TaskStateRunning: {TaskStateCompleted},
+
+	TaskStateCompleted: {TaskStateResolving},
+
+	// demoted back to completed if the stager stops resolving
+	TaskStateResolving: {TaskStateCompleted},
+}
+
+type IllegalTransitionError struct {
+	From TaskState
+	To   TaskState
+}
+
+func (err IllegalTransitionError) Error() string {
+	return fmt.Sprintf("illegal task state transition from %v to %v", err.From, err.To)
+}
+
+func (state TaskState) CanTransitionTo(to TaskState) bool {
+	for _, legal := range legalTransitions[state] {
+		if legal == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// TransitionTo moves the task to the given state, or returns an
+// IllegalTransitionError and leaves the task untouched.
+func (self *Task) TransitionTo(state TaskState) error {
+	if !self.State.CanTransitionTo(state) {
+		return IllegalTransitionError{From: self.State, To: state}
+	}
+
+	self.State = state
+
+	return nil
+}
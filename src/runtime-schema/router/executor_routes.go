@@ -0,0 +1,19 @@
+package router
+
+const (
+	EXECUTOR_CLAIM_TASK = "claim_task"
+	EXECUTOR_CAPACITY   = "capacity"
+	EXECUTOR_LIST_TASKS = "list_tasks"
+	EXECUTOR_GET_TASK   = "get_task"
+	EXECUTOR_DRAIN      = "drain"
+)
+
+func NewExecutorRoutes() Routes {
+	return Routes{
+		{Path: "/tasks", Method: "POST", Handler: EXECUTOR_CLAIM_TASK},
+		{Path: "/capacity", Method: "GET", Handler: EXECUTOR_CAPACITY},
+		{Path: "/tasks", Method: "GET", Handler: EXECUTOR_LIST_TASKS},
+		{Path: "/tasks/:guid", Method: "GET", Handler: EXECUTOR_GET_TASK},
+		{Path: "/drain", Method: "POST", Handler: EXECUTOR_DRAIN},
+	}
+}
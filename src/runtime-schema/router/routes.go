@@ -49,6 +49,31 @@ func (r Routes) RouteForHandler(handler string) (Route, bool) {
 	return Route{}, false
 }
 
+// URLForHandler builds the fully-qualified URL for the handler's route on
+// the server at baseURL, e.g. http://10.0.0.1:8080/droplet/some-guid.
+func (r Routes) URLForHandler(baseURL string, handler string, params map[string]string) (string, error) {
+	route, ok := r.RouteForHandler(handler)
+	if !ok {
+		return "", fmt.Errorf("missing handler %s", handler)
+	}
+
+	path, err := route.PathWithParams(params)
+	if err != nil {
+		return "", err
+	}
+
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return "", err
+	}
+
+	if base.Scheme == "" || base.Host == "" {
+		return "", fmt.Errorf("invalid base URL: %s", baseURL)
+	}
+
+	return strings.TrimRight(baseURL, "/") + path, nil
+}
+
 func (r Routes) Router(actions Handlers) (http.Handler, error) {
 	p := pat.New()
 	for _, route := range r {
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/yagnats"
+	"github.com/onsi/ginkgo/cleanup"
+
+	"runtime-schema/models"
+	"simulator/logger"
+)
+
+type convergenceData struct {
+	Time     float64                  `json:"time"`
+	Executor string                   `json:"executor"`
+	Counts   map[string]int           `json:"counts"`
+	Sample   models.ConvergenceReport `json:"sample"`
+}
+
+func (d *convergenceData) toJson() []byte {
+	data, err := json.Marshal(d)
+	if err != nil {
+		logger.Error("convergence.marshal.convergenceData.failed", err)
+	}
+	return data
+}
+
+func monitorConvergence(natsClient yagnats.NATSClient) {
+	out, err := os.Create(filepath.Join(outDir, "convergence.log"))
+	if err != nil {
+		logger.Fatal("convergence.log.creation.failure", err)
+	}
+
+	cleanup.Register(func() {
+		out.Sync()
+	})
+
+	_, err = natsClient.Subscribe("info.executor.*.converged", func(msg *yagnats.Message) {
+		var convergedLog struct {
+			Timestamp time.Time                `json:"_timestamp"`
+			Counts    map[string]int           `json:"counts"`
+			Sample    models.ConvergenceReport `json:"sample"`
+		}
+
+		err := json.Unmarshal(msg.Payload, &convergedLog)
+		if err != nil {
+			logger.Error("convergence.decode.failed", err)
+			return
+		}
+
+		// info.executor.<id>.converged
+		subject := strings.Split(msg.Subject, ".")
+
+		d := convergenceData{
+			Time:     float64(convergedLog.Timestamp.UnixNano()) / 1e9,
+			Executor: subject[2],
+			Counts:   convergedLog.Counts,
+			Sample:   convergedLog.Sample,
+		}
+
+		logger.Info("convergence.recorded", d.Executor, d.Counts)
+		out.Write(d.toJson())
+		out.Write([]byte("\n"))
+	})
+	if err != nil {
+		logger.Fatal("convergence.subscribe.failed", err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/cloudfoundry/gunk/timeprovider"
 	"github.com/cloudfoundry/storeadapter/etcdstoreadapter"
 	"github.com/onsi/ginkgo/cleanup"
 
@@ -24,6 +25,12 @@ type etcdData struct {
 	Completed         int            `json:"completed"`
 	PresentExecutors  int            `json:"present_executors"`
 	RunningByExecutor map[string]int `json:"running_by_executor"`
+
+	TotalMemory               int            `json:"total_memory"`
+	AvailableMemory           int            `json:"available_memory"`
+	TotalDisk                 int            `json:"total_disk"`
+	AvailableDisk             int            `json:"available_disk"`
+	AvailableMemoryByExecutor map[string]int `json:"available_memory_by_executor"`
 }
 
 func (d *etcdData) toJson() []byte {
@@ -35,7 +42,7 @@ func (d *etcdData) toJson() []byte {
 }
 
 func (d *etcdData) String() string {
-	return fmt.Sprintf("Executors: %d Pending: %d, Claimed: %d, Running: %d, Completed: %d", d.PresentExecutors, d.Pending, d.Claimed, d.Running, d.Completed)
+	return fmt.Sprintf("Executors: %d Pending: %d, Claimed: %d, Running: %d, Completed: %d, Memory: %d/%d", d.PresentExecutors, d.Pending, d.Claimed, d.Running, d.Completed, d.AvailableMemory, d.TotalMemory)
 }
 
 func monitorETCD(etcdAdapter *etcdstoreadapter.ETCDStoreAdapter) {
@@ -48,6 +55,8 @@ func monitorETCD(etcdAdapter *etcdstoreadapter.ETCDStoreAdapter) {
 		out.Sync()
 	})
 
+	bbs := Bbs.New(Bbs.NopKicker{}, etcdAdapter, timeprovider.NewTimeProvider())
+
 	go func() {
 		ticker := time.NewTicker(time.Second)
 		for {
@@ -59,36 +68,47 @@ func monitorETCD(etcdAdapter *etcdstoreadapter.ETCDStoreAdapter) {
 				logger.Info("fetch.etcd.runOnceNodes.error", err)
 			}
 
-			executorNode, err := etcdAdapter.ListRecursively(Bbs.ExecutorSchemaRoot)
+			executorPresences, err := bbs.GetAllExecutorPresences()
 			if err != nil {
-				logger.Info("fetch.etcd.executorNode.error", err)
+				logger.Info("fetch.etcd.executorPresences.error", err)
 			}
 			readTime := time.Since(t)
 
 			d := etcdData{
-				Time:              float64(time.Now().UnixNano()) / 1e9,
-				RunningByExecutor: map[string]int{},
-				PresentExecutors:  len(executorNode.ChildNodes),
-				ReadTime:          float64(readTime) / 1e9,
+				Time:                      float64(time.Now().UnixNano()) / 1e9,
+				RunningByExecutor:         map[string]int{},
+				PresentExecutors:          len(executorPresences),
+				ReadTime:                  float64(readTime) / 1e9,
+				AvailableMemoryByExecutor: map[string]int{},
 			}
 
-			for _, node := range runOnceNodes.ChildNodes {
-				runOnce, err := models.NewTaskFromJSON(node.Value)
-				if err != nil {
-					logger.Error("etcd.decode.runonce", err)
-					continue
-				}
+			for _, presence := range executorPresences {
+				d.TotalMemory += presence.Total.MemoryMB
+				d.AvailableMemory += presence.Available.MemoryMB
+				d.TotalDisk += presence.Total.DiskMB
+				d.AvailableDisk += presence.Available.DiskMB
+				d.AvailableMemoryByExecutor[presence.ExecutorID] = presence.Available.MemoryMB
+			}
+
+			for _, shard := range runOnceNodes.ChildNodes {
+				for _, node := range shard.ChildNodes {
+					runOnce, err := models.NewTaskFromJSON(node.Value)
+					if err != nil {
+						logger.Error("etcd.decode.runonce", err)
+						continue
+					}
 
-				switch runOnce.State {
-				case models.TaskStatePending:
-					d.Pending++
-				case models.TaskStateClaimed:
-					d.Claimed++
-				case models.TaskStateRunning:
-					d.Running++
-					d.RunningByExecutor[runOnce.ExecutorID]++
-				case models.TaskStateCompleted:
-					d.Completed++
+					switch runOnce.State {
+					case models.TaskStatePending:
+						d.Pending++
+					case models.TaskStateClaimed:
+						d.Claimed++
+					case models.TaskStateRunning:
+						d.Running++
+						d.RunningByExecutor[runOnce.ExecutorID]++
+					case models.TaskStateCompleted:
+						d.Completed++
+					}
 				}
 			}
 
@@ -123,6 +123,9 @@ func main() {
 	//monitor etcd
 	monitorETCD(etcdAdapter)
 
+	//record convergence reports
+	monitorConvergence(natsClient)
+
 	//run the simulator
 	runSimulation(natsClient)
 
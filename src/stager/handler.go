@@ -42,7 +42,7 @@ func (handler *Handler) ServeHTTP(writer http.ResponseWriter, request *http.Requ
 func (handler *Handler) resolveTask(task *models.Task) {
 	err := handler.bbs.ResolvingTask(task)
 	if err != nil {
-		logger.Info("handler.resolving-failed", map[string]interface{}{
+		logger.Info(storeFailure("handler.resolving", err), map[string]interface{}{
 			"task":  task.Guid,
 			"error": err.Error(),
 		})
@@ -50,7 +50,7 @@ func (handler *Handler) resolveTask(task *models.Task) {
 		return
 	}
 
-	err = handler.natsClient.Publish(task.ReplyTo, task.ToJSON())
+	err = handler.publishCompletion(task)
 	if err != nil {
 		logger.Error("handler.publish-failed", map[string]interface{}{
 			"task":  task.Guid,
@@ -62,7 +62,7 @@ func (handler *Handler) resolveTask(task *models.Task) {
 
 	err = handler.bbs.ResolveTask(task)
 	if err != nil {
-		logger.Error("handler.resolve-failed", map[string]interface{}{
+		logger.Error(storeFailure("handler.resolve", err), map[string]interface{}{
 			"task":  task.Guid,
 			"error": err.Error(),
 		})
@@ -74,3 +74,29 @@ func (handler *Handler) resolveTask(task *models.Task) {
 		"task": task.Guid,
 	})
 }
+
+// publishCompletion replies to whoever desired the task: staging tasks get a
+// response for the CC, anything else gets the task itself.
+func (handler *Handler) publishCompletion(task *models.Task) error {
+	if task.Type != models.TaskTypeStaging {
+		return handler.natsClient.Publish(task.ReplyTo, task.ToJSON())
+	}
+
+	payload, err := json.Marshal(stagingResponse(task))
+	if err != nil {
+		return err
+	}
+
+	return handler.natsClient.Publish(task.ReplyTo, payload)
+}
+
+// storeFailure names the log subject for a failed BBS operation, telling
+// timeouts (where the outcome is unknown, and convergence will try again)
+// apart from outright failures.
+func storeFailure(operation string, err error) string {
+	if _, isTimeout := err.(bbs.StoreTimeoutError); isTimeout {
+		return operation + "-timed-out"
+	}
+
+	return operation + "-failed"
+}
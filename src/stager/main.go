@@ -8,6 +8,7 @@ import (
 	"math/rand"
 	"net/http"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -51,6 +52,12 @@ var natsPassword = flag.String(
 
 var hurlerAddress = flag.String("hurlerAddress", "127.0.0.1:9090", "hurler address")
 
+var compilers = flag.String(
+	"compilers",
+	"{}",
+	"JSON map of stack names to the URLs of their compilers",
+)
+
 var stop = make(chan bool)
 var tasks = &sync.WaitGroup{}
 var once = &sync.Once{}
@@ -114,7 +121,17 @@ func main() {
 		})
 	}
 
-	bbs := bbs.New(bbs.NewHurlerKicker(*hurlerAddress), etcdAdapter, timeprovider.NewTimeProvider())
+	compilersByStack := map[string]string{}
+
+	err = json.Unmarshal([]byte(*compilers), &compilersByStack)
+	if err != nil {
+		logger.Fatal("compilers.invalid", map[string]interface{}{
+			"error":     err.Error(),
+			"compilers": *compilers,
+		})
+	}
+
+	bbs := bbs.NewWithConfig(bbs.NewHurlerKicker(*hurlerAddress), etcdAdapter, timeprovider.NewTimeProvider(), bbsConfig(compilersByStack))
 
 	ready := make(chan bool, 1)
 
@@ -129,6 +146,9 @@ func main() {
 
 	handleStaging(bbs, natsClient)
 
+	handleStagingRequests(bbs, natsClient, compilersByStack)
+	handleStopStagingRequests(bbs, natsClient)
+
 	<-ready
 
 	logger.Info("up", map[string]interface{}{
@@ -138,6 +158,20 @@ func main() {
 	select {}
 }
 
+// bbsConfig only lets tasks ask for stacks the stager has a compiler for.
+func bbsConfig(compilersByStack map[string]string) bbs.Config {
+	config := bbs.DefaultConfig
+
+	config.KnownStacks = []string{}
+	for stack := range compilersByStack {
+		config.KnownStacks = append(config.KnownStacks, stack)
+	}
+
+	sort.Strings(config.KnownStacks)
+
+	return config
+}
+
 func handleTasks(bbs bbs.StagerBBS, natsClient yagnats.NATSClient, listenAddr string) {
 	err := http.ListenAndServe(listenAddr, &Handler{
 		bbs:        bbs,
@@ -157,10 +191,13 @@ func handleStaging(bbs bbs.StagerBBS, natsClient yagnats.NATSClient) {
 
 		err := json.Unmarshal(msg.Payload, &message)
 		if err != nil {
-			logger.Fatal("staging-request.invalid", map[string]interface{}{
+			logger.Error("staging-request.invalid", map[string]interface{}{
 				"error":   err.Error(),
 				"payload": string(msg.Payload),
 			})
+
+			replyWithFailure(natsClient, msg.ReplyTo, &models.Task{}, "invalid staging request: "+err.Error())
+
 			return
 		}
 
@@ -171,6 +208,10 @@ func handleStaging(bbs bbs.StagerBBS, natsClient yagnats.NATSClient) {
 				Guid:     fmt.Sprintf("task-%d", guid),
 				MemoryMB: message.MemoryMB,
 
+				Actions: []models.ExecutorAction{
+					{Action: models.RunAction{Script: "true"}},
+				},
+
 				ReplyTo: msg.ReplyTo,
 			}
 
@@ -178,11 +219,43 @@ func handleStaging(bbs bbs.StagerBBS, natsClient yagnats.NATSClient) {
 				"task": task,
 			})
 
-			go bbs.DesireTask(task)
+			go desireTask(bbs, natsClient, task)
 		}
 	})
 }
 
+func desireTask(bbs bbs.StagerBBS, natsClient yagnats.NATSClient, task *models.Task) {
+	err := bbs.DesireTask(task)
+	if err != nil {
+		logger.Error(storeFailure("staging-request.desire", err), map[string]interface{}{
+			"task":  task.Guid,
+			"error": err.Error(),
+		})
+
+		replyWithFailure(natsClient, task.ReplyTo, task, err.Error())
+	}
+}
+
+// replyWithFailure tells the requester that the task will never run, in the
+// same form as a failed completion.
+func replyWithFailure(natsClient yagnats.NATSClient, replyTo string, task *models.Task, reason string) {
+	if replyTo == "" {
+		return
+	}
+
+	failed := *task
+	failed.Failed = true
+	failed.FailureReason = reason
+
+	err := natsClient.Publish(replyTo, failed.ToJSON())
+	if err != nil {
+		logger.Error("staging-request.reply-failed", map[string]interface{}{
+			"task":  task.Guid,
+			"error": err.Error(),
+		})
+	}
+}
+
 func registerHandler(etcdAdapter *etcdstoreadapter.ETCDStoreAdapter, addr string, ready chan<- bool) error {
 	node := storeadapter.StoreNode{
 		Key: "/v1/routes/round-robin/stager/" + addr,
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cloudfoundry/yagnats"
+
+	"logger"
+	"runtime-schema/bbs"
+	"runtime-schema/models"
+	"runtime-schema/router"
+)
+
+const stagingLogSource = "STG"
+
+const smeltingTimeout = 15 * time.Minute
+
+// handleStagingRequests desires a staging task for each staging request from
+// the CC, using the compiler for the request's stack. The CC is replied to
+// once the task completes, or right away if it can't be desired.
+func handleStagingRequests(bbs bbs.StagerBBS, natsClient yagnats.NATSClient, compilers map[string]string) {
+	natsClient.SubscribeWithQueue("diego.staging.start", "stager", func(msg *yagnats.Message) {
+		var request models.StagingRequestFromCC
+
+		err := json.Unmarshal(msg.Payload, &request)
+		if err != nil {
+			logger.Error("staging.invalid-request", map[string]interface{}{
+				"error":   err.Error(),
+				"payload": string(msg.Payload),
+			})
+
+			replyToCC(natsClient, msg.ReplyTo, models.StagingResponseForCC{
+				Error: "invalid staging request: " + err.Error(),
+			})
+
+			return
+		}
+
+		go stage(bbs, natsClient, compilers, request, msg.ReplyTo)
+	})
+}
+
+// handleStopStagingRequests cancels the staging task for each stop request
+// from the CC. The CC hears about the cancellation through the usual
+// completion reply to its staging request.
+func handleStopStagingRequests(bbs bbs.StagerBBS, natsClient yagnats.NATSClient) {
+	natsClient.SubscribeWithQueue("diego.staging.stop", "stager", func(msg *yagnats.Message) {
+		var request models.StopStagingRequestFromCC
+
+		err := json.Unmarshal(msg.Payload, &request)
+		if err != nil {
+			logger.Error("staging.invalid-stop-request", map[string]interface{}{
+				"error":   err.Error(),
+				"payload": string(msg.Payload),
+			})
+
+			return
+		}
+
+		go stopStaging(bbs, request)
+	})
+}
+
+func stopStaging(bbs bbs.StagerBBS, request models.StopStagingRequestFromCC) {
+	guid := stagingTaskGuid(request.AppId, request.TaskId)
+
+	logger.Info("staging.stop", map[string]interface{}{
+		"task": guid,
+	})
+
+	err := bbs.CancelTask(guid)
+	if err != nil {
+		logger.Error(storeFailure("staging.stop", err), map[string]interface{}{
+			"task":  guid,
+			"error": err.Error(),
+		})
+	}
+}
+
+func stage(bbs bbs.StagerBBS, natsClient yagnats.NATSClient, compilers map[string]string, request models.StagingRequestFromCC, replyTo string) {
+	compilerURL, found := compilers[request.Stack]
+	if !found {
+		logger.Error("staging.unknown-stack", map[string]interface{}{
+			"app":   request.AppId,
+			"stack": request.Stack,
+		})
+
+		replyToCC(natsClient, replyTo, models.StagingResponseForCC{
+			Error: fmt.Sprintf("no compiler defined for requested stack %q", request.Stack),
+		})
+
+		return
+	}
+
+	guid := stagingTaskGuid(request.AppId, request.TaskId)
+
+	fileServerURL, err := bbs.GetAvailableFileServer()
+	if err != nil {
+		logger.Error("staging.no-file-server", map[string]interface{}{
+			"app":   request.AppId,
+			"error": err.Error(),
+		})
+
+		replyToCC(natsClient, replyTo, models.StagingResponseForCC{
+			Error: "no file server is available to receive the droplet",
+		})
+
+		return
+	}
+
+	dropletUploadURL, err := router.NewFileServerRoutes().URLForHandler(fileServerURL, router.FS_UPLOAD_DROPLET, map[string]string{
+		"guid": guid,
+	})
+	if err != nil {
+		logger.Error("staging.invalid-file-server", map[string]interface{}{
+			"app":         request.AppId,
+			"file-server": fileServerURL,
+			"error":       err.Error(),
+		})
+
+		replyToCC(natsClient, replyTo, models.StagingResponseForCC{
+			Error: "no file server is available to receive the droplet",
+		})
+
+		return
+	}
+
+	task := stagingTask(request, compilerURL, dropletUploadURL, replyTo)
+
+	logger.Info("staging.desire", map[string]interface{}{
+		"task": task,
+	})
+
+	err = bbs.DesireTaskIdempotently(task)
+	if err != nil {
+		logger.Error(storeFailure("staging.desire", err), map[string]interface{}{
+			"task":  task.Guid,
+			"error": err.Error(),
+		})
+
+		replyToCC(natsClient, replyTo, models.StagingResponseForCC{
+			Error: err.Error(),
+		})
+	}
+}
+
+func stagingTaskGuid(appId string, taskId string) string {
+	return fmt.Sprintf("%s-%s", appId, taskId)
+}
+
+// stagingTask downloads the compiler, the app and its buildpacks, runs the
+// smelter over them, uploads the droplet and fetches the smelter's result.
+func stagingTask(request models.StagingRequestFromCC, compilerURL string, dropletUploadURL string, replyTo string) *models.Task {
+	buildpackKeys := []string{}
+	for _, buildpack := range request.Buildpacks {
+		buildpackKeys = append(buildpackKeys, buildpack.Key)
+	}
+
+	smeltingConfig := models.NewLinuxSmeltingConfig(buildpackKeys)
+
+	actions := []models.ExecutorAction{
+		{
+			Action: models.DownloadAction{
+				From:    compilerURL,
+				To:      smeltingConfig.CompilerPath(),
+				Extract: true,
+			},
+		},
+		{
+			Action: models.DownloadAction{
+				From:    request.AppBitsDownloadUri,
+				To:      smeltingConfig.AppDir(),
+				Extract: true,
+			},
+		},
+	}
+
+	for _, buildpack := range request.Buildpacks {
+		actions = append(actions, models.ExecutorAction{
+			Action: models.DownloadAction{
+				From:    buildpack.Url,
+				To:      smeltingConfig.BuildpackPath(buildpack.Key),
+				Extract: true,
+			},
+		})
+	}
+
+	actions = append(actions,
+		models.ExecutorAction{
+			Action: models.RunAction{
+				Script:  smeltingConfig.Script(),
+				Env:     request.Environment,
+				Timeout: smeltingTimeout,
+			},
+		},
+		models.ExecutorAction{
+			Action: models.UploadAction{
+				From: smeltingConfig.DropletArchivePath(),
+				To:   dropletUploadURL,
+			},
+		},
+		models.ExecutorAction{
+			Action: models.FetchResultAction{
+				File: smeltingConfig.ResultJsonPath(),
+			},
+		},
+	)
+
+	return &models.Task{
+		Guid:            stagingTaskGuid(request.AppId, request.TaskId),
+		Type:            models.TaskTypeStaging,
+		Actions:         actions,
+		Stack:           request.Stack,
+		FileDescriptors: request.FileDescriptors,
+		MemoryMB:        request.MemoryMB,
+		DiskMB:          request.DiskMB,
+
+		Log: models.LogConfig{
+			Guid:       request.AppId,
+			SourceName: stagingLogSource,
+		},
+
+		ReplyTo: replyTo,
+	}
+}
+
+// stagingResponse reports a completed staging task to the CC, using the
+// smelter's result if it succeeded.
+func stagingResponse(task *models.Task) models.StagingResponseForCC {
+	if task.Failed {
+		return models.StagingResponseForCC{
+			Error: sanitizeFailureReason(task.FailureReason),
+		}
+	}
+
+	var info models.StagingInfo
+
+	err := json.Unmarshal([]byte(task.Result), &info)
+	if err != nil {
+		logger.Error("staging.invalid-result", map[string]interface{}{
+			"task":   task.Guid,
+			"result": task.Result,
+			"error":  err.Error(),
+		})
+
+		return models.StagingResponseForCC{
+			Error: "staging produced an invalid result",
+		}
+	}
+
+	return models.StagingResponseForCC{
+		DetectedBuildpack: info.DetectedBuildpack,
+	}
+}
+
+const maxFailureReasonLength = 256
+
+var urlPattern = regexp.MustCompile(`[a-z][a-z0-9+.-]*://[^\s]+`)
+
+// sanitizeFailureReason turns a task's failure reason into something fit for
+// the CC: failures of our own making are described rather than quoted, and
+// anything else is cut down to one short line with URLs (which may carry
+// credentials) removed.
+func sanitizeFailureReason(reason string) string {
+	switch {
+	case reason == bbs.TaskCancelledReason:
+		return "staging was cancelled"
+	case reason == bbs.TaskUnclaimedReason:
+		return "no executor was available to stage the app"
+	case reason == bbs.TaskExecutorDisappearedReason:
+		return "staging was interrupted"
+	case strings.HasPrefix(reason, "failed to create container"):
+		return "failed to create a container for staging"
+	}
+
+	reason = strings.TrimSpace(strings.SplitN(reason, "\n", 2)[0])
+	reason = urlPattern.ReplaceAllString(reason, "<url>")
+
+	if len(reason) > maxFailureReasonLength {
+		// cut before whichever character straddles the limit, not through it
+		cut := maxFailureReasonLength
+		for cut > 0 && !utf8.RuneStart(reason[cut]) {
+			cut--
+		}
+
+		reason = reason[:cut] + "..."
+	}
+
+	if reason == "" {
+		return "staging failed"
+	}
+
+	return "staging failed: " + reason
+}
+
+func replyToCC(natsClient yagnats.NATSClient, replyTo string, response models.StagingResponseForCC) {
+	if replyTo == "" {
+		return
+	}
+
+	payload, err := json.Marshal(response)
+	if err != nil {
+		panic(err)
+	}
+
+	err = natsClient.Publish(replyTo, payload)
+	if err != nil {
+		logger.Error("staging.reply-failed", map[string]interface{}{
+			"reply-to": replyTo,
+			"error":    err.Error(),
+		})
+	}
+}